@@ -0,0 +1,147 @@
+package giashard
+
+/*
+The columns of a batch are separate files that must have a line for every
+row. If one is shorter than the others, reading stops at the shortest, and
+the rows after the missing lines may well be paired up wrongly. Readers
+check that every column ends at the same row, and by default fail with an
+AlignErr if they don't. Lenient modes instead read up to the shortest
+column or pad the short columns with empty values, with a warning.
+*/
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+type AlignMode int
+
+const (
+	AlignStrict   AlignMode = iota // fail
+	AlignTruncate                  // stop at the end of the shortest column
+	AlignPad                       // go on to the end of the longest column
+)
+
+var alignModes = map[string]AlignMode{"strict": AlignStrict, "truncate": AlignTruncate, "pad": AlignPad}
+
+func ParseAlignMode(mode string) (m AlignMode, err error) {
+	m, ok := alignModes[mode]
+	if !ok {
+		err = fmt.Errorf("unknown alignment mode %v, expected strict, truncate or pad", mode)
+	}
+	return
+}
+
+// columns of a batch with different numbers of rows
+type AlignErr struct {
+	Dir  string
+	Cols []string
+	Rows []int64 // rows in each column
+}
+
+var AlignError *AlignErr
+
+func (ae *AlignErr) Error() string {
+	counts := make([]string, len(ae.Cols))
+	for i, c := range ae.Cols {
+		counts[i] = fmt.Sprintf("%v %d", c, ae.Rows[i])
+	}
+	return fmt.Sprintf("columns of %v have different numbers of rows: %v", ae.Dir, strings.Join(counts, ", "))
+}
+
+func (ae *AlignErr) Is(target error) bool {
+	_, ok := target.(*AlignErr)
+	return ok
+}
+
+// the fewest and most rows of any column
+func (ae *AlignErr) Range() (min int64, max int64) {
+	for i, n := range ae.Rows {
+		if i == 0 || n < min {
+			min = n
+		}
+		if n > max {
+			max = n
+		}
+	}
+	return
+}
+
+// what to do when the columns being read end at different rows
+func (r *ColumnReader) Align(mode AlignMode) {
+	r.align = mode
+}
+
+// some columns have ended and others have not. work out what to do about
+// it, reading on to count the rest of the rows unless padding
+func (r *ColumnReader) misaligned() (more bool) {
+	if r.align == AlignPad {
+		return true
+	}
+	for i, lr := range r.readers {
+		if r.ended[i] {
+			continue
+		}
+		for lr.Next() {
+			r.counts[i]++
+		}
+		if err := lr.Err(); err != nil {
+			r.err = fmt.Errorf("column %v: %w", r.names[i], err)
+			return false
+		}
+	}
+	err := &AlignErr{r.dir, r.names, r.counts}
+	if r.align == AlignStrict {
+		r.err = err
+	} else {
+		min, _ := err.Range()
+		log.Printf("Warning: %v. Truncating to %d rows", err, min)
+	}
+	return false
+}
+
+// at the end of padded columns, say if any needed padding
+func (r *ColumnReader) padded() {
+	err := &AlignErr{r.dir, r.names, r.counts}
+	if min, max := err.Range(); min != max {
+		log.Printf("Warning: %v. Padded to %d rows", err, max)
+	}
+}
+
+// check that the columns of the batch at dir all have the same number of
+// rows, from its metadata if it has any, or else by reading them through
+func BatchAligned(dir string, cols ...string) (err error) {
+	rows := make([]int64, len(cols))
+	if m, e := ReadBatchMeta(dir); e == nil {
+		for i, c := range cols {
+			cm, ok := m.Columns[c]
+			if !ok {
+				return fmt.Errorf("column %v of %v is not in its metadata", c, dir)
+			}
+			rows[i] = cm.Rows
+		}
+	} else {
+		for i, c := range cols {
+			fname := ColumnFile(dir, c)
+			r, err := NewLineReader(fname)
+			if err != nil {
+				return err
+			}
+			for r.Next() {
+				rows[i]++
+			}
+			err = r.Err()
+			r.Close()
+			if err != nil {
+				return fmt.Errorf("reading %v: %w", fname, err)
+			}
+		}
+	}
+	for _, n := range rows {
+		if n != rows[0] {
+			return &AlignErr{dir, cols, rows}
+		}
+	}
+	return
+}
@@ -0,0 +1,78 @@
+package giashard
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func writeColumn(t *testing.T, dir string, col string, n int) {
+	w, err := NewLineWriter(filepath.Join(dir, col+".gz"))
+	if err != nil {
+		t.Fatalf("NewLineWriter: error: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		w.WriteLine([]byte(fmt.Sprintf("%s %d", col, i)))
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Close: error: %v", err)
+	}
+}
+
+func TestAlign(t *testing.T) {
+	dir := t.TempDir()
+	writeColumn(t, dir, "url", 5)
+	writeColumn(t, dir, "text", 3)
+
+	tests := []struct {
+		mode AlignMode
+		rows int
+		err  bool
+	}{
+		{AlignStrict, 3, true},
+		{AlignTruncate, 3, false},
+		{AlignPad, 5, false},
+	}
+	for _, test := range tests {
+		r, err := NewColumnReader(dir, "url", "text")
+		if err != nil {
+			t.Fatalf("NewColumnReader: error: %v", err)
+		}
+		r.Align(test.mode)
+		n := 0
+		for r.Next() {
+			row := r.Row()
+			if n >= 3 && len(row["text"]) != 0 {
+				t.Errorf("mode %d: expected row %d to be padded, got %q", test.mode, n, row["text"])
+			}
+			n++
+		}
+		r.Close()
+		if n != test.rows {
+			t.Errorf("mode %d: expected %d rows, got %d", test.mode, test.rows, n)
+		}
+		err = r.Err()
+		if !test.err {
+			if err != nil {
+				t.Errorf("mode %d: unexpected error: %v", test.mode, err)
+			}
+			continue
+		}
+		var ae *AlignErr
+		if !errors.Is(err, AlignError) || !errors.As(err, &ae) {
+			t.Fatalf("mode %d: expected an AlignErr, got %v", test.mode, err)
+		}
+		if min, max := ae.Range(); min != 3 || max != 5 || ae.Dir != dir {
+			t.Errorf("mode %d: expected 3 and 5 rows in %v, got %v", test.mode, dir, ae)
+		}
+	}
+
+	if err := BatchAligned(dir, "url", "text"); !errors.Is(err, AlignError) {
+		t.Errorf("BatchAligned: expected an AlignErr, got %v", err)
+	}
+	writeColumn(t, dir, "text", 2)
+	if err := BatchAligned(dir, "url", "text"); err != nil {
+		t.Errorf("BatchAligned: unexpected error: %v", err)
+	}
+}
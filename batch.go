@@ -30,6 +30,12 @@ type Batch struct {
 	count int64   // running count
 	cols []string // columns
 	writer *ColumnWriter
+	rows int64    // rows in the current batch, if counted
+	counted bool  // whether rows were counted when the batch was opened
+	hook SealHook // called as each batch is sealed
+	sources map[string]bool // sources of the rows in the current batch
+	stride int    // how far apart the numbers of successive batches are
+	every int64   // rows between row index entries, 0 for no index
 }
 
 func NewBatch(dir string, size int64, cols ...string) (b *Batch, err error) {
@@ -47,7 +53,7 @@ func NewBatch(dir string, size int64, cols ...string) (b *Batch, err error) {
 		return
 	}
 
-	b = &Batch{dir, batchno, size, 0, cols, nil}
+	b = newBatch(dir, batchno, size, 1, cols)
 
 	if err = b.openBatch(); err != nil {
 		return
@@ -56,32 +62,52 @@ func NewBatch(dir string, size int64, cols ...string) (b *Batch, err error) {
 	return
 }
 
+// a batch at dir that carries on from the given batch number, numbering
+// batches stride apart
+func newBatch(dir string, number int, size int64, stride int, cols []string) *Batch {
+	return &Batch{
+		dir: dir,
+		number: number,
+		size: size,
+		cols: cols,
+		sources: make(map[string]bool),
+		stride: stride,
+	}
+}
+
 func (b *Batch)Close() (err error) {
 	if b.writer != nil {
-		err = b.writer.Close()
+		err = b.seal()
 	}
 	return
 }
 
-func (b *Batch)WriteRow(row map[string][]byte) (err error) {
-	// find the size of the row (max of data values)
-	rowsize := 0
+// find the size of the row (max of data values), as counted towards the
+// batch size
+func RowSize(row map[string][]byte) (rowsize int64) {
 	for _, v := range row {
-		if len(v) > rowsize {
-			rowsize = len(v)
+		if int64(len(v)) > rowsize {
+			rowsize = int64(len(v))
 		}
 	}
+	return
+}
+
+func (b *Batch)WriteRow(row map[string][]byte) (err error) {
+	rowsize := RowSize(row)
 
 	// if we've overflowed past this batch size, close the writer
 	// and increment the batch number
-	if int64(rowsize) + b.count > b.size {
+	if rowsize + b.count > b.size {
 		log.Printf("Writing row of size %v onto dataset of size %v would exceed %v. Rotating", rowsize, b.count, b.size)
 		if b.writer != nil {
-			b.writer.Close()
-			b.writer = nil
+			if err = b.seal(); err != nil {
+				return
+			}
 		}
 		b.count = 0
-		b.number += 1
+		b.rows = 0
+		b.number += b.stride
 	}
 
 	// construct a new writer if we need one
@@ -98,11 +124,55 @@ func (b *Batch)WriteRow(row map[string][]byte) (err error) {
 		log.Printf("Error writing row to batch %s", b.batchPath())
 		return
 	}
-	b.count += int64(rowsize)
+	b.count += rowsize
+	b.rows += 1
+	if source, ok := row["source"]; ok && !b.sources[string(source)] {
+		b.sources[string(source)] = true
+	}
 
 	return
 }
 
+// count the rows already in the current batch, so that Last gives the
+// right row number when appending to an existing batch. this means
+// reading through one of its columns
+func (b *Batch)CountRows() (err error) {
+	if b.counted {
+		return
+	}
+	fname := ColumnFile(b.batchPath(), b.cols[0])
+	fi, err := os.Stat(fname)
+	if os.IsNotExist(err) || (err == nil && fi.Size() == 0) {
+		b.counted = true
+		return nil
+	} else if err != nil {
+		return
+	}
+	r, err := NewLineReader(fname)
+	if err != nil {
+		return
+	}
+	n := int64(0)
+	for r.Next() {
+		n += 1
+	}
+	err = r.Err()
+	if e := r.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	b.rows += n
+	b.counted = true
+	return
+}
+
+// the batch number and row within it of the last row written
+func (b *Batch)Last() (number int, row int64) {
+	return b.number, b.rows - 1
+}
+
 func (b *Batch)batchPath() string {
 	return filepath.Join(b.dir, strconv.FormatInt(int64(b.number), 10))
 }
@@ -123,10 +193,32 @@ func (b *Batch)openBatch() (err error) {
 		return
 	}
 	b.count = count
-	b.writer, err = NewColumnWriter(bdir, b.cols...)
+	if b.writer, err = NewColumnWriter(bdir, b.cols...); err != nil {
+		return
+	}
+	if b.every > 0 {
+		err = b.indexRows()
+	}
 	return
 }
 
+// keep a row index in each batch, with an entry every n rows, so that
+// readers can start part way through. see rowindex.go
+func (b *Batch)IndexRows(n int64) (err error) {
+	b.every = n
+	if b.writer != nil {
+		err = b.indexRows()
+	}
+	return
+}
+
+func (b *Batch)indexRows() (err error) {
+	if err = b.CountRows(); err != nil {
+		return
+	}
+	return b.writer.IndexRows(b.every, b.rows)
+}
+
 // find the end of the current batch. this means walking directory to find
 // the numerically greatest
 func Maxbatch(dir string) (batchno int, err error) {
@@ -164,7 +256,7 @@ func Maxbatch(dir string) (batchno int, err error) {
 func Batchsize(dir string, cols ...string) (size int64, err error) {
 	// find the maximum filesize of compressed files
 	for _, c := range cols {
-		colpath := filepath.Join(dir, c + ".gz")
+		colpath := ColumnFile(dir, c)
 		fi, err := os.Stat(colpath)
 		if err != nil {
 			// errors are ok only if none of the files exist. if we
@@ -0,0 +1,177 @@
+package giashard
+
+/*
+A blocklist names domains and url prefixes that must not be in a tree, for
+opt-outs and takedown requests. A blocklist file has one entry per line,
+with # comments:
+
+    # the whole domain, and every host under it
+    example.com
+    # just part of a site, with or without the scheme
+    https://example.org/private/
+    example.net/users/
+
+An entry without a / is a domain, anything else is a url prefix. Scheme
+and host are compared without regard to case, the rest of the url as it
+is.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/weppos/publicsuffix-go/publicsuffix"
+)
+
+type Blocklist struct {
+	entries  []string
+	domains  map[string]bool
+	prefixes []string
+}
+
+// lowercase the scheme and host of a url or url prefix, returning it with
+// and without the scheme
+func lowerHost(u string) (full string, bare string) {
+	scheme := ""
+	if i := strings.Index(u, "://"); i >= 0 {
+		scheme, u = strings.ToLower(u[:i+3]), u[i+3:]
+	}
+	end := strings.IndexAny(u, "/?#")
+	if end < 0 {
+		end = len(u)
+	}
+	bare = strings.ToLower(u[:end]) + u[end:]
+	return scheme + bare, bare
+}
+
+func NewBlocklist(entries ...string) (bl *Blocklist, err error) {
+	bl = &Blocklist{domains: make(map[string]bool)}
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			return nil, fmt.Errorf("empty blocklist entry")
+		}
+		bl.entries = append(bl.entries, e)
+		if strings.Contains(e, "/") {
+			full, _ := lowerHost(e)
+			bl.prefixes = append(bl.prefixes, full)
+		} else {
+			bl.domains[strings.TrimSuffix(strings.ToLower(e), ".")] = true
+		}
+	}
+	return
+}
+
+func ReadBlocklist(filename string) (bl *Blocklist, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			entries = append(entries, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	return NewBlocklist(entries...)
+}
+
+func (bl *Blocklist) Entries() []string {
+	return bl.entries
+}
+
+// the entry that blocks the url, if any
+func (bl *Blocklist) Match(u string) (entry string, ok bool) {
+	if len(bl.domains) > 0 {
+		if host, err := Host(u); err == nil {
+			host = strings.TrimSuffix(strings.ToLower(host), ".")
+			for {
+				if bl.domains[host] {
+					return host, true
+				}
+				i := strings.Index(host, ".")
+				if i < 0 {
+					break
+				}
+				host = host[i+1:]
+			}
+		}
+	}
+	if len(bl.prefixes) > 0 {
+		full, bare := lowerHost(u)
+		for _, p := range bl.prefixes {
+			if strings.HasPrefix(full, p) || strings.HasPrefix(bare, p) {
+				return p, true
+			}
+		}
+	}
+	return
+}
+
+// the shards of the tree that rows matching the blocklist may be in
+func (bl *Blocklist) Shards(m *Manifest) (shards []uint64, err error) {
+	seen := make(map[uint64]bool)
+	add := func(ids ...uint64) {
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				shards = append(shards, id)
+			}
+		}
+	}
+
+	for _, e := range bl.entries {
+		key := e
+		if !strings.Contains(key, "://") {
+			key = "http://" + key
+		}
+		// the hosts under a public or private suffix, such as blogspot.com,
+		// each have a slug of their own, and may be in any shard
+		if host, err := Host(key); err == nil {
+			if _, err = publicsuffix.Parse(host); err != nil {
+				shards = nil
+				for id := uint64(0); id < 1<<m.Shards; id++ {
+					shards = append(shards, id)
+				}
+				return shards, nil
+			}
+		}
+		slug, err := Slug(m.canonicalKey(key))
+		if err != nil {
+			return nil, fmt.Errorf("blocklist entry %v: %w", e, err)
+		}
+		if id, ok := m.slugpins[slug]; ok {
+			add(id)
+		} else {
+			add(m.slugShards(slug)...)
+		}
+	}
+	// a domain entry covers its subdomains, which host pins may have put
+	// anywhere
+	for _, p := range m.Pins {
+		if p.Host {
+			add(p.Shard)
+		}
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i] < shards[j] })
+	return
+}
+
+// leave out rows whose key is on the blocklist. they are counted in the
+// summary
+func (s *Shard) Block(bl *Blocklist) {
+	s.blocklist = bl
+}
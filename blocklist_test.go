@@ -0,0 +1,49 @@
+package giashard
+
+import (
+	"testing"
+)
+
+func TestBlocklist(t *testing.T) {
+	bl, err := NewBlocklist("example.com", "https://Example.ORG/private/", "example.net/users/")
+	if err != nil {
+		t.Fatalf("NewBlocklist: error: %v", err)
+	}
+
+	var blockcases = [...]struct {
+		url     string
+		blocked bool
+	}{
+		{"http://example.com/", true},
+		{"https://www.EXAMPLE.com/page", true},
+		{"https://notexample.com/", false},
+		{"https://example.org/private/x", true},
+		{"http://example.org/private/x", false},
+		{"https://example.org/public/", false},
+		{"http://example.net/users/me", true},
+		{"https://example.net/Users/me", false},
+	}
+	for _, tcase := range blockcases {
+		if _, blocked := bl.Match(tcase.url); blocked != tcase.blocked {
+			t.Errorf("Match(%v): expected %v got %v", tcase.url, tcase.blocked, blocked)
+		}
+	}
+
+	m := NewManifest(8, "url")
+	shards, err := bl.Shards(m)
+	if err != nil {
+		t.Fatalf("Shards: error: %v", err)
+	}
+	// all three are the same slug
+	if len(shards) != 1 || shards[0] != slugShard("example", 8) {
+		t.Errorf("Shards: expected [%d] got %v", slugShard("example", 8), shards)
+	}
+
+	// the hosts under a suffix may be in any shard
+	if bl, err = NewBlocklist("blogspot.com"); err != nil {
+		t.Fatalf("NewBlocklist: error: %v", err)
+	}
+	if shards, err = bl.Shards(NewManifest(2, "url")); err != nil || len(shards) != 4 {
+		t.Errorf("Shards: expected all 4 shards for a suffix, got %v, %v", shards, err)
+	}
+}
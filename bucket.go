@@ -0,0 +1,113 @@
+package giashard
+
+/*
+Without buckets, the batch a row lands in depends on the order rows come
+in and on when the batch happened to rotate. With buckets, each shard is
+split into a fixed number of buckets by a second hash of the key, and
+batches rotate within each bucket. The bucket of a row then depends on
+its key alone.
+
+Buckets share the shard's directory, and are told apart by their batch
+numbers: bucket j of k has batches j+1, j+1+k, j+1+2k, and so on. Tools
+that only know about numbered batches keep working as they are.
+*/
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// split every shard into k buckets. the number of buckets is recorded in
+// the manifest, and a tree can only ever have one
+func (m *Manifest) SetBuckets(k uint) (err error) {
+	if k < 1 {
+		return fmt.Errorf("a shard needs at least one bucket")
+	}
+	if m.Buckets != 0 && m.Buckets != k {
+		return fmt.Errorf("the tree already has %d buckets per shard", m.Buckets)
+	}
+	m.Buckets = k
+	return
+}
+
+// the bucket that key falls in, within its shard
+func (m *Manifest) Bucket(key string) uint {
+	if m.Buckets < 2 {
+		return 0
+	}
+	return uint(URLHash([]byte(m.canonicalKey(key))) % uint64(m.Buckets))
+}
+
+// the bucket a batch number belongs to
+func BatchBucket(number int, k uint) uint {
+	if k < 2 {
+		return 0
+	}
+	return uint(number-1) % k
+}
+
+// a batch that writes the given bucket of k, in the shard at dir
+func NewBucketBatch(dir string, size int64, bucket uint, k uint, cols ...string) (b *Batch, err error) {
+	batchno, err := maxBucketBatch(dir, bucket, k)
+	if err != nil {
+		return
+	}
+	b = newBatch(dir, batchno, size, int(k), cols)
+	err = b.openBatch()
+	return
+}
+
+// the last batch of the bucket, or its first if it has none yet
+func maxBucketBatch(dir string, bucket uint, k uint) (batchno int, err error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return
+	}
+
+	batchno = int(bucket) + 1
+	for _, name := range names {
+		i, err := strconv.Atoi(name)
+		if err != nil || i < 1 {
+			continue
+		}
+		if BatchBucket(i, k) == bucket && i > batchno {
+			batchno = i
+		}
+	}
+	return
+}
+
+// split every shard into k buckets by a hash of the key, so that the
+// bucket a row lands in does not depend on the input order. must be
+// called before any rows are written. a tree that already has batches
+// without buckets can't be given any, as its batches would then be taken
+// for buckets while holding rows of every bucket
+func (s *Shard) Buckets(k uint) (err error) {
+	if k > 1 && s.manifest.Buckets == 0 {
+		shards, err := Batches(s.dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, shard := range shards {
+			if batches, err := Batches(shard); err != nil {
+				return err
+			} else if len(batches) > 0 {
+				return fmt.Errorf("%v already has batches without buckets", s.dir)
+			}
+		}
+	}
+	if err = s.manifest.SetBuckets(k); err != nil {
+		return
+	}
+	s.batches = make([]*Batch, (1<<s.n)*int(k))
+	if s.dist != nil {
+		s.dist.setBuckets(k)
+	}
+	return
+}
@@ -0,0 +1,237 @@
+package giashard
+
+/*
+URLs that differ only in their scheme, a www. prefix, a trailing slash,
+their fragment, a default port or tracking parameters usually point at the
+same document. A canonicaliser rewrites them to a single form, according to
+a set of rules:
+
+    lower      lowercase the scheme and host
+    scheme     use https rather than http
+    www        strip a leading www. from the host
+    port       drop the default port for the scheme
+    fragment   drop the fragment
+    slash      drop a trailing slash from the path
+    tracking   drop tracking parameters such as utm_* and fbclid
+    sortquery  sort the query parameters
+
+The canonical url can be used as the key for sharding, and written as a
+column of its own.
+*/
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+var CanonicalRules = []string{"lower", "scheme", "www", "port", "fragment", "slash", "tracking", "sortquery"}
+
+// query parameters dropped by the tracking rule. a trailing * matches
+// any suffix
+var TrackingParams = []string{
+	"utm_*", "fbclid", "gclid", "dclid", "gbraid", "wbraid", "msclkid",
+	"yclid", "igshid", "mc_cid", "mc_eid", "_ga", "_hsenc", "_hsmi",
+}
+
+type Canonicaliser struct {
+	rules  map[string]bool
+	params []string
+}
+
+// make a canonicaliser applying the named rules, or all of them if none
+// are given
+func NewCanonicaliser(rules ...string) (c *Canonicaliser, err error) {
+	if len(rules) == 0 {
+		rules = CanonicalRules
+	}
+	c = &Canonicaliser{rules: make(map[string]bool), params: TrackingParams}
+	for _, r := range rules {
+		known := false
+		for _, k := range CanonicalRules {
+			known = known || r == k
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown canonicalisation rule %v", r)
+		}
+		c.rules[r] = true
+	}
+	return
+}
+
+// the rules applied, in a fixed order
+func (c *Canonicaliser) Rules() (rules []string) {
+	for _, r := range CanonicalRules {
+		if c.rules[r] {
+			rules = append(rules, r)
+		}
+	}
+	return
+}
+
+func (c *Canonicaliser) tracking(param string) bool {
+	param = strings.ToLower(param)
+	for _, p := range c.params {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(param, p[:len(p)-1]) {
+				return true
+			}
+		} else if param == p {
+			return true
+		}
+	}
+	return false
+}
+
+// the canonical form of the url. anything that can't be parsed as an
+// absolute url is returned as it is
+func (c *Canonicaliser) Canonicalise(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return raw
+	}
+
+	if c.rules["lower"] {
+		u.Scheme = strings.ToLower(u.Scheme)
+		u.Host = strings.ToLower(u.Host)
+	}
+	if c.rules["port"] {
+		port := u.Port()
+		if (port == "80" && strings.EqualFold(u.Scheme, "http")) || (port == "443" && strings.EqualFold(u.Scheme, "https")) {
+			u.Host = strings.TrimSuffix(u.Host, ":"+port)
+		}
+	}
+	if c.rules["scheme"] && strings.EqualFold(u.Scheme, "http") {
+		u.Scheme = "https"
+	}
+	if c.rules["www"] && len(u.Host) > 4 && strings.EqualFold(u.Host[:4], "www.") {
+		u.Host = u.Host[4:]
+	}
+	if c.rules["fragment"] {
+		u.Fragment = ""
+		u.RawFragment = ""
+	}
+	if c.rules["slash"] {
+		if len(u.Path) > 1 {
+			u.Path = strings.TrimRight(u.Path, "/")
+			u.RawPath = ""
+		}
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	}
+	if (c.rules["tracking"] || c.rules["sortquery"]) && u.RawQuery != "" {
+		u.RawQuery = c.query(u.RawQuery)
+	}
+	return u.String()
+}
+
+// filter and sort the raw query string, leaving the parameters encoded
+// as they were
+func (c *Canonicaliser) query(raw string) string {
+	params := strings.Split(raw, "&")
+	kept := params[:0]
+	for _, p := range params {
+		if p == "" {
+			continue
+		}
+		name := p
+		if i := strings.Index(p, "="); i >= 0 {
+			name = p[:i]
+		}
+		if c.rules["tracking"] {
+			if n, err := url.QueryUnescape(name); err == nil && c.tracking(n) {
+				continue
+			}
+		}
+		kept = append(kept, p)
+	}
+	if c.rules["sortquery"] {
+		sort.Strings(kept)
+	}
+	return strings.Join(kept, "&")
+}
+
+// A Transform rewrites rows before they are sharded. It may change the
+// row in place, and returns false to drop it.
+type Transform interface {
+	Transform(row map[string][]byte) (keep bool, err error)
+}
+
+// writes the canonical form of one column to another
+type CanonicalColumn struct {
+	c    *Canonicaliser
+	from string
+	to   string
+}
+
+func NewCanonicalColumn(c *Canonicaliser, from string, to string) *CanonicalColumn {
+	return &CanonicalColumn{c, from, to}
+}
+
+func (cc *CanonicalColumn) Transform(row map[string][]byte) (keep bool, err error) {
+	row[cc.to] = []byte(cc.c.Canonicalise(string(row[cc.from])))
+	return true, nil
+}
+
+// pass rows through the transforms, in order, before anything else
+func (s *Shard) Transform(ts ...Transform) {
+	s.transforms = append(s.transforms, ts...)
+}
+
+// transforms that count what they do leave rows that are only scanned,
+// see ScanRow, out of their counts
+type scanTransform interface {
+	scan(row map[string][]byte) (keep bool, err error)
+}
+
+// pass a copy of the row through the transforms, without counting it,
+// returning nil if the row is dropped
+func (s *Shard) scanTransforms(row map[string][]byte) map[string][]byte {
+	if len(s.transforms) == 0 {
+		return row
+	}
+	scanned := make(map[string][]byte, len(row))
+	for k, v := range row {
+		scanned[k] = v
+	}
+	for _, t := range s.transforms {
+		var keep bool
+		var err error
+		if st, ok := t.(scanTransform); ok {
+			keep, err = st.scan(scanned)
+		} else {
+			keep, err = t.Transform(scanned)
+		}
+		if err != nil || !keep {
+			return nil
+		}
+	}
+	return scanned
+}
+
+// shard, index and split by the canonical form of the key, rather than
+// the key as it is. the rules are recorded in the manifest, and a tree
+// can only be canonicalised one way
+func (s *Shard) CanonicaliseKey(c *Canonicaliser) (err error) {
+	return s.manifest.Canonicalise(c)
+}
+
+func (m *Manifest) Canonicalise(c *Canonicaliser) (err error) {
+	rules := c.Rules()
+	if m.Canonical != nil && strings.Join(m.Canonical, ",") != strings.Join(rules, ",") {
+		return fmt.Errorf("the tree's keys are already canonicalised by %v", strings.Join(m.Canonical, ","))
+	}
+	m.Canonical = rules
+	m.canonicaliser = c
+	return
+}
+
+// the key as used for sharding in this tree
+func (m *Manifest) canonicalKey(key string) string {
+	if m.canonicaliser == nil {
+		return key
+	}
+	return m.canonicaliser.Canonicalise(key)
+}
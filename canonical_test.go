@@ -0,0 +1,33 @@
+package giashard
+
+import (
+	"testing"
+)
+
+func TestCanonicalise(t *testing.T) {
+	var canoncases = [...]struct {
+		rules []string
+		url   string
+		canon string
+	}{
+		{nil, "HTTP://WWW.Example.com:80/a/b/?utm_source=x&b=2&a=1#top", "https://example.com/a/b?a=1&b=2"},
+		{nil, "https://example.com", "https://example.com/"},
+		{nil, "https://example.com:8080/?fbclid=1", "https://example.com:8080/"},
+		{[]string{"tracking"}, "http://www.example.com/?b=2&UTM_medium=y&a=1", "http://www.example.com/?b=2&a=1"},
+		{[]string{"www", "fragment"}, "http://www.example.com/x/#y", "http://example.com/x/"},
+		{nil, "/relative/path", "/relative/path"},
+	}
+	for _, tcase := range canoncases {
+		c, err := NewCanonicaliser(tcase.rules...)
+		if err != nil {
+			t.Fatalf("NewCanonicaliser(%v): error: %v", tcase.rules, err)
+		}
+		if canon := c.Canonicalise(tcase.url); canon != tcase.canon {
+			t.Errorf("Canonicalise(%v) with %v: expected %v got %v", tcase.url, tcase.rules, tcase.canon, canon)
+		}
+	}
+
+	if _, err := NewCanonicaliser("nosuchrule"); err == nil {
+		t.Errorf("NewCanonicaliser accepted an unknown rule")
+	}
+}
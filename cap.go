@@ -0,0 +1,171 @@
+package giashard
+
+/*
+Caps limit how much any one slug, or slug and language, contributes to a
+tree: at most a number of documents, a number of bytes, or both. Which
+rows of a slug are kept does not depend on the order of the input: rows
+are ranked by a hash of their key and the lowest ranked rows that fit
+under the cap are kept. This needs the whole input to be scanned once
+before sharding, to find for each slug the hash beyond which rows are
+over the cap.
+
+While scanning, each slug, or slug and language, holds the hash and size
+of the rows that fit under its cap so far, 16 bytes a row: at most docs
+rows under a document cap, but under a byte cap alone as many rows as
+fit in it, so a byte cap on its own with many small rows takes the most
+memory. Once scanning is done only the cut off of each group over the
+cap is kept.
+*/
+
+import (
+	"container/heap"
+	"math"
+)
+
+type Capper struct {
+	docs    int64  // per group, 0 for no limit
+	bytes   int64  // per group, 0 for no limit
+	langcol string // group by slug and the language in this column, if set
+
+	groups  map[string]*capGroup // while scanning
+	cutoffs map[string]uint64    // groups that are over the cap
+}
+
+// the lowest hashing rows of a group seen so far that fit under the cap
+type capGroup struct {
+	rows   capHeap
+	bytes  int64
+	cutoff uint64 // rows hashing this high or higher don't fit
+}
+
+type capRow struct {
+	hash uint64
+	size int64
+}
+
+// max heap of rows by hash
+type capHeap []capRow
+
+func (h capHeap) Len() int            { return len(h) }
+func (h capHeap) Less(i, j int) bool  { return h[i].hash > h[j].hash }
+func (h capHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *capHeap) Push(x interface{}) { *h = append(*h, x.(capRow)) }
+func (h *capHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// cap each slug at docs rows and bytes bytes, either being 0 for no
+// limit. if langcol is given, each language of a slug is capped separately
+func NewCapper(docs int64, bytes int64, langcol string) *Capper {
+	return &Capper{docs: docs, bytes: bytes, langcol: langcol, groups: make(map[string]*capGroup)}
+}
+
+func (c *Capper) group(slug string, row map[string][]byte) string {
+	if c.langcol == "" {
+		return slug
+	}
+	return slug + "\t" + string(row[c.langcol])
+}
+
+func (c *Capper) over(g *capGroup) bool {
+	return (c.docs > 0 && int64(len(g.rows)) > c.docs) || (c.bytes > 0 && g.bytes > c.bytes)
+}
+
+// count a row with the given slug and key towards the caps. all rows
+// must be scanned before any are kept
+func (c *Capper) Scan(slug string, key string, row map[string][]byte) {
+	name := c.group(slug, row)
+	g, ok := c.groups[name]
+	if !ok {
+		g = &capGroup{cutoff: math.MaxUint64}
+		c.groups[name] = g
+	}
+
+	r := capRow{URLHash([]byte(key)), RowSize(row)}
+	if r.hash >= g.cutoff {
+		return
+	}
+	heap.Push(&g.rows, r)
+	g.bytes += r.size
+	for c.over(g) {
+		r := heap.Pop(&g.rows).(capRow)
+		g.bytes -= r.size
+		g.cutoff = r.hash
+	}
+}
+
+// done scanning: remember only where the groups that are over the cap
+// are cut off
+func (c *Capper) finish() {
+	c.cutoffs = make(map[string]uint64)
+	for name, g := range c.groups {
+		if g.cutoff != math.MaxUint64 {
+			c.cutoffs[name] = g.cutoff
+		}
+	}
+	c.groups = nil
+}
+
+// is the row under the cap for its slug
+func (c *Capper) Keep(slug string, key string, row map[string][]byte) bool {
+	if c.cutoffs == nil {
+		c.finish()
+	}
+	cutoff, ok := c.cutoffs[c.group(slug, row)]
+	return !ok || URLHash([]byte(key)) < cutoff
+}
+
+// the number of slugs, or slugs and languages, that are over the cap
+func (c *Capper) Capped() int {
+	if c.cutoffs == nil {
+		c.finish()
+	}
+	return len(c.cutoffs)
+}
+
+// cap the rows written for each slug. rows over the cap are written to
+// overflow, if it is given, and dropped otherwise. every row must first
+// be passed to ScanRow
+func (s *Shard) Cap(c *Capper, overflow *Shard) {
+	s.capper = c
+	s.overflow = overflow
+}
+
+// count the row towards the caps, if it would get that far when written
+func (s *Shard) ScanRow(row map[string][]byte) {
+	if s.capper == nil {
+		return
+	}
+	if row = s.scanTransforms(row); row == nil {
+		return
+	}
+	if s.filter != nil && s.filter.reject(row) != nil {
+		return
+	}
+	if s.blocklist != nil {
+		if _, blocked := s.blocklist.Match(string(row[s.key])); blocked {
+			return
+		}
+	}
+	key := s.manifest.canonicalKey(string(row[s.key]))
+	slug, _, err := s.locate(key)
+	if err != nil {
+		return
+	}
+	if sp := s.manifest.Sample; sp != nil && !sp.Keep(slug, row) {
+		return
+	}
+	s.capper.Scan(slug, key, row)
+}
+
+// write the row to the overflow, if there is one
+func (s *Shard) capRow(row map[string][]byte) (err error) {
+	s.summary.Capped++
+	if s.overflow != nil {
+		err = s.overflow.WriteRow(row)
+	}
+	return
+}
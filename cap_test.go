@@ -0,0 +1,89 @@
+package giashard
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+)
+
+func TestCapper(t *testing.T) {
+	var rows []map[string][]byte
+	for i := 0; i < 100; i++ {
+		rows = append(rows, map[string][]byte{
+			"url":  []byte(fmt.Sprintf("https://example.com/%d", i)),
+			"lang": []byte([]string{"en", "de"}[i%2]),
+		})
+	}
+
+	kept := func(c *Capper, reverse bool) (keep map[string]bool) {
+		for i := range rows {
+			if reverse {
+				i = len(rows) - 1 - i
+			}
+			c.Scan("example", string(rows[i]["url"]), rows[i])
+		}
+		keep = make(map[string]bool)
+		for _, row := range rows {
+			if c.Keep("example", string(row["url"]), row) {
+				keep[string(row["url"])] = true
+			}
+		}
+		return
+	}
+
+	forward, backward := kept(NewCapper(10, 0, ""), false), kept(NewCapper(10, 0, ""), true)
+	if len(forward) != 10 {
+		t.Errorf("expected 10 rows under the cap, got %d", len(forward))
+	}
+	for u := range forward {
+		if !backward[u] {
+			t.Errorf("%v kept in one order but not the other", u)
+		}
+	}
+
+	if n := len(kept(NewCapper(10, 0, "lang"), false)); n != 20 {
+		t.Errorf("expected 10 rows per language, got %d in all", n)
+	}
+
+	size := RowSize(rows[0]) // all rows with one digit have the same size
+	if n := len(kept(NewCapper(0, 3*size+1, ""), false)); n < 2 || n > 3 {
+		t.Errorf("expected 2 or 3 rows under the byte cap, got %d", n)
+	}
+}
+
+func TestShardCapTransforms(t *testing.T) {
+	s, err := NewShard(t.TempDir(), 0, 1<<30, "url", "url", "text")
+	if err != nil {
+		t.Fatalf("NewShard: error: %v", err)
+	}
+	n, err := NewNormaliser("text", "none", InvalidDrop, false)
+	if err != nil {
+		t.Fatalf("NewNormaliser: error: %v", err)
+	}
+	s.Transform(n)
+	s.Cap(NewCapper(1, 0, ""), nil)
+
+	// only the one row the normaliser keeps counts towards the cap
+	var rows []map[string][]byte
+	for i := 0; i < 20; i++ {
+		text := base64.StdEncoding.EncodeToString([]byte("invalid \xff"))
+		if i == 10 {
+			text = base64.StdEncoding.EncodeToString([]byte("valid"))
+		}
+		rows = append(rows, map[string][]byte{"url": []byte(fmt.Sprintf("https://example.com/%d", i)), "text": []byte(text)})
+	}
+	for _, row := range rows {
+		s.ScanRow(row)
+	}
+	for _, row := range rows {
+		if err = s.WriteRow(row); err != nil {
+			t.Fatalf("WriteRow: error: %v", err)
+		}
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close: error: %v", err)
+	}
+	if sum := s.Summary(); sum.Capped != 0 || sum.Normalise.Dropped != 19 {
+		t.Errorf("expected no rows capped and 19 dropped once each, got %d and %d", sum.Capped, sum.Normalise.Dropped)
+	}
+}
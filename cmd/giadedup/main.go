@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/paracrawl/giashard"
+)
+
+var textcol string
+var clustercol string
+var shingle int
+var hashes int
+var threshold float64
+var seed int64
+
+func init() {
+	flag.StringVar(&textcol, "t", "plain_text", "Column holding the base64 encoded text")
+	flag.StringVar(&clustercol, "c", "", "Rather than dropping near-duplicates, write a cluster id column with this name")
+	flag.IntVar(&shingle, "k", 5, "Number of words per shingle")
+	flag.IntVar(&hashes, "m", 64, "Number of MinHash functions")
+	flag.Float64Var(&threshold, "j", 0.8, "Jaccard similarity above which documents are near-duplicates")
+	flag.Int64Var(&seed, "seed", 1, "Seed for the MinHash functions")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] shard directories\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), `Finds near-duplicate documents within each shard using MinHash and
+locality sensitive hashing. Either rewrites the batches keeping only the first
+document of each cluster, or adds a column giving the cluster of each
+document, identified by the position of its first document in the shard.
+`)
+	}
+}
+
+func decode(text []byte) []byte {
+	buf := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+	n, err := base64.StdEncoding.Decode(buf, text)
+	if err != nil {
+		return text
+	}
+	return buf[:n]
+}
+
+func dedupshard(shard string, mh *giashard.MinHasher) {
+	batches, err := giashard.Batches(shard)
+	if err != nil {
+		log.Fatalf("Error listing batches of %v: %v", shard, err)
+	}
+
+	// first pass: signatures of every document in the shard, in order
+	lsh, err := giashard.NewLSH(hashes, threshold)
+	if err != nil {
+		log.Fatalf("Error setting up LSH: %v", err)
+	}
+	sizes := make([]int, 0, len(batches))
+	for _, batch := range batches {
+		r, err := giashard.NewColumnReader(batch, textcol)
+		if err != nil {
+			log.Fatalf("Error reading %v: %v", batch, err)
+		}
+		n := 0
+		for r.Next() {
+			lsh.Add(mh.Signature(decode(r.Row()[textcol])))
+			n++
+		}
+		if err = r.Err(); err != nil {
+			log.Fatalf("Error reading %v: %v", batch, err)
+		}
+		if err = r.Close(); err != nil {
+			log.Printf("Error closing %v: %v", batch, err)
+		}
+		sizes = append(sizes, n)
+	}
+
+	dups := 0
+	for id := 0; id < lsh.Len(); id++ {
+		if lsh.Cluster(id) != id {
+			dups++
+		}
+	}
+	log.Printf("Shard %v: %d of %d documents are near-duplicates", shard, dups, lsh.Len())
+
+	// second pass: rewrite or annotate each batch
+	first := 0
+	for b, batch := range batches {
+		if clustercol != "" {
+			writeclusters(batch, lsh, first, sizes[b])
+		} else {
+			dropdups(batch, lsh, first)
+		}
+		first += sizes[b]
+	}
+}
+
+func writeclusters(batch string, lsh *giashard.LSH, first int, n int) {
+	// whether it was written with gzip or zstd
+	fname := giashard.ColumnFile(batch, clustercol)
+	if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Error removing old cluster column: %v", err)
+	}
+	w, err := giashard.NewLineWriter(giashard.ColumnOutputFile(batch, clustercol))
+	if err != nil {
+		log.Fatalf("Error writing cluster column: %v", err)
+	}
+	for id := first; id < first+n; id++ {
+		if err = w.WriteLine([]byte(strconv.Itoa(lsh.Cluster(id)))); err != nil {
+			log.Fatalf("Error writing cluster column: %v", err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		log.Fatalf("Error writing cluster column: %v", err)
+	}
+	if err = giashard.RefreshBatchMeta(batch); err != nil {
+		log.Fatalf("Error writing metadata of %v: %v", batch, err)
+	}
+}
+
+func dropdups(batch string, lsh *giashard.LSH, first int) {
+	cols, err := giashard.BatchColumns(batch)
+	if err != nil {
+		log.Fatalf("Error listing columns of %v: %v", batch, err)
+	}
+	kept, dropped, err := giashard.RewriteBatch(batch, cols, func(i int64, row map[string][]byte) (bool, error) {
+		id := first + int(i)
+		return lsh.Cluster(id) == id, nil
+	})
+	if err != nil {
+		log.Fatalf("Error rewriting %v: %v", batch, err)
+	}
+	log.Printf("Batch %v: kept %d, dropped %d", batch, kept, dropped)
+}
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+	if threshold <= 0 || threshold > 1 {
+		log.Fatalf("Similarity threshold %v is not in (0, 1]", threshold)
+	}
+	if hashes < 1 {
+		log.Fatalf("Number of MinHash functions -m must be at least 1, not %d", hashes)
+	}
+
+	mh := giashard.NewMinHasher(hashes, shingle, seed)
+	for i := 0; i < flag.NArg(); i++ {
+		dedupshard(flag.Arg(i), mh)
+	}
+}
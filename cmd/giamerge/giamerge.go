@@ -16,12 +16,20 @@ var outdir string
 var shards uint
 var batchsize int64
 var fileslist string
+var verify bool
+var recompress bool
+var level int
+var workers int
 
 func init() {
 	flag.StringVar(&outdir, "o", ".", "Output location")
 	flag.StringVar(&fileslist, "f", "plain_text,url,mime,source", "Files to shard, separated by commas")
 	flag.UintVar(&shards, "n", 8, "Number of shards (2^n)")
 	flag.Int64Var(&batchsize, "b", 100, "Batch size in MB")
+	flag.BoolVar(&verify, "verify", false, "Check each input batch against its metadata before merging it")
+	flag.BoolVar(&recompress, "recompress", false, "Decompress the batches and compress them again with -level and -workers, rather than copying them as they are")
+	flag.IntVar(&level, "level", 9, "Gzip compression level when recompressing, from 1 (fastest) to 9 (smallest)")
+	flag.IntVar(&workers, "workers", 0, "Compress on this many goroutines shared by all columns when recompressing (0 or 1 to compress each column as it is written)")
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] input directories\n", os.Args[0])
 		flag.PrintDefaults()
@@ -29,11 +37,100 @@ func init() {
 	}
 }
 
+// the size of a batch, from its metadata if it has any, otherwise
+// estimated from the size of its files
+func size(dir string, schema []string) (size int64, err error) {
+	m, err := giashard.ReadBatchMeta(dir)
+	if err != nil {
+		return giashard.Batchsize(dir, schema...)
+	}
+	for _, c := range schema {
+		if cm, ok := m.Columns[c]; ok && cm.Bytes > size {
+			size = cm.Bytes
+		}
+	}
+	return
+}
+
+// append the lines of the compressed file to w
+func copylines(w *giashard.LineWriter, fname string) (err error) {
+	r, err := giashard.NewLineReader(fname)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	for r.Next() {
+		if err = w.WriteLine(r.Line()); err != nil {
+			return
+		}
+	}
+	return r.Err()
+}
+
+// the writer of column c of the batch, either a line writer or the file
+// itself to copy compressed columns to as they are. a writer of the other
+// kind is closed first, so that what it wrote is finished
+func writer(writers map[string]io.WriteCloser, c string, fname string, lines bool) (w io.WriteCloser) {
+	w, ok := writers[c]
+	if _, islines := w.(*giashard.LineWriter); ok && islines == lines {
+		return
+	} else if ok {
+		if err := w.Close(); err != nil {
+			log.Fatalf("error closing writer for %v: %v", c, err)
+		}
+	}
+	var err error
+	if lines {
+		w, err = giashard.NewLineWriter(fname)
+	} else {
+		w, err = os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	writers[c] = w
+	return
+}
+
+// give the output the dictionary of column c of the input batch at src,
+// if the input has one and the output doesn't, so that batches merged
+// into new output batches can be copied as they are
+func adoptdict(src string, c string) (err error) {
+	from := giashard.FindDict(src, c)
+	if from == "" || giashard.TreeDict(outdir, c) != "" {
+		return
+	}
+	d, err := giashard.ReadDict(from)
+	if err != nil {
+		return
+	}
+	log.Printf("Using %v as the dictionary for %v", from, c)
+	return giashard.WriteDict(outdir, c, d)
+}
+
+// close the writers of a batch and describe it in its metadata
+func seal(dst string, writers map[string]io.WriteCloser, sources []string) {
+	for c, w := range writers {
+		if err := w.Close(); err != nil {
+			log.Printf("error closing writer for %v: %v ", c, err)
+		}
+	}
+	if len(writers) == 0 {
+		return
+	}
+	if err := giashard.RefreshBatchMeta(dst, sources...); err != nil {
+		log.Fatalf("error writing metadata of %v: %v", dst, err)
+	}
+}
+
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 	flag.Parse()
 
 	schema := strings.Split(fileslist, ",")
+	if err := giashard.SetCompression(level, workers); err != nil {
+		log.Fatal(err)
+	}
 
 	maxsize := batchsize * 1024 * 1024
 
@@ -49,17 +146,29 @@ func main() {
 	dst := filepath.Join(outdir, strconv.FormatInt(int64(bno), 10))
 
 	writers := make(map[string]io.WriteCloser)
+	var sources []string
+
+	dsize, err := size(dst, schema)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	for i:=0; i<flag.NArg(); i++ {
 		src := flag.Arg(i)
 
-		dsize, err := giashard.Batchsize(dst, schema...)
-		if err != nil {
-			log.Fatal(err)
+		if verify {
+			if err = giashard.VerifyBatch(src); err != nil {
+				log.Fatal(err)
+			}
 		}
+		// appending misaligned columns would misalign the output too
+		if err = giashard.BatchAligned(src, schema...); err != nil {
+			log.Fatalf("Not merging %v: %v", src, err)
+		}
+
 		log.Printf("Destination %v estimated size %v", dst, dsize)
 
-		ssize, err := giashard.Batchsize(src, schema...)
+		ssize, err := size(src, schema)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -67,14 +176,12 @@ func main() {
 
 		if dsize + ssize > maxsize {
 			log.Printf("Appending would overflow. Rotating.")
+			seal(dst, writers, sources)
 			bno += 1
 			dst = filepath.Join(outdir, strconv.FormatInt(int64(bno), 10))
-			for c, w := range writers {
-				if err = w.Close(); err != nil {
-					log.Printf("error closing writer for %v: %v ", c, err)
-				}
-			}
 			writers = make(map[string]io.WriteCloser)
+			sources = nil
+			dsize = 0
 		}
 
 		err = os.MkdirAll(dst, os.ModePerm)
@@ -83,30 +190,44 @@ func main() {
 		}
 
 		for _, c := range schema {
-			sfname := filepath.Join(src, c + ".gz")
-			sfp, err := os.Open(sfname)
+			if err = adoptdict(src, c); err != nil {
+				log.Fatalf("error copying dictionary of %v: %v", c, err)
+			}
+			sfname := giashard.ColumnFile(src, c)
+			dfname := giashard.ColumnOutputFile(dst, c)
+			same, err := giashard.SameCompression(sfname, dfname)
 			if err != nil {
 				log.Fatal(err)
 			}
+			if recompress || !same {
+				if !same && !recompress {
+					log.Printf("Recompressing %v, as it is not compressed as %v is", sfname, dfname)
+				}
+				w := writer(writers, c, dfname, true)
+				if err = copylines(w.(*giashard.LineWriter), sfname); err != nil {
+					log.Fatalf("error recompressing %v: %v", sfname, err)
+				}
+				continue
+			}
 
-			dfp, ok := writers[c]
-			if !ok {
-				dfname := filepath.Join(dst, c + ".gz")
-				dfp, err = os.OpenFile(dfname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.ModePerm)
-				writers[c] = dfp
+			sfp, err := os.Open(sfname)
+			if err != nil {
+				log.Fatal(err)
 			}
 
+			dfp := writer(writers, c, dfname, false)
+
 			io.Copy(dfp, sfp)
 
 			sfp.Close()
 		}
+		dsize += ssize
+		if m, err := giashard.ReadBatchMeta(src); err == nil {
+			sources = append(sources, m.Sources...)
+		}
 	}
 
 	log.Printf("cleaning up.")
-	for c, w := range writers {
-		if err = w.Close(); err != nil {
-			log.Printf("error closing writer for %v: %v ", c, err)
-		}
-	}
+	seal(dst, writers, sources)
 	log.Printf("done.")
 }
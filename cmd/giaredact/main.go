@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/paracrawl/giashard"
+)
+
+var textcol string
+var countcol string
+var rulenames string
+var rulefile string
+
+func init() {
+	flag.StringVar(&textcol, "t", "plain_text", "Column holding the base64 encoded text")
+	flag.StringVar(&countcol, "c", "", "Also write the number of redactions of each kind in a document to this column")
+	flag.StringVar(&rulenames, "r", "", "Built in rules to apply, separated by commas (default all of "+strings.Join(giashard.RedactRuleNames(), ", ")+")")
+	flag.StringVar(&rulefile, "rules", "", "File of further rules, one name and regular expression per line")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] tree directories\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), `Redacts personal information in the text of every batch of existing trees,
+replacing e-mail addresses, IBANs, IP addresses, phone numbers and matches of
+any further rules with placeholders such as [EMAIL].
+`)
+	}
+}
+
+func redactbatch(batch string, rd *giashard.Redactor) {
+	in, err := giashard.BatchColumns(batch)
+	if err != nil {
+		log.Fatalf("Error listing columns of %v: %v", batch, err)
+	}
+	out := in
+	if countcol != "" {
+		// replace the counts of an earlier run
+		out = nil
+		for _, c := range in {
+			if c != countcol {
+				out = append(out, c)
+			}
+		}
+		in = out
+		out = append(append([]string{}, in...), countcol)
+	}
+	if _, _, err = giashard.RewriteBatchColumns(batch, in, out, func(i int64, row map[string][]byte) (bool, error) {
+		return rd.Transform(row)
+	}); err != nil {
+		log.Fatalf("Error rewriting %v: %v", batch, err)
+	}
+}
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	var names []string
+	if rulenames != "" {
+		names = strings.Split(rulenames, ",")
+	}
+	rules, err := giashard.RedactRules(names...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if rulefile != "" {
+		more, err := giashard.ReadRedactRules(rulefile)
+		if err != nil {
+			log.Fatalf("Error reading redaction rules: %v", err)
+		}
+		rules = append(rules, more...)
+	}
+	rd := giashard.NewRedactor(textcol, rules...)
+	if countcol != "" {
+		rd.CountColumn(countcol)
+	}
+
+	for _, tree := range flag.Args() {
+		shards, err := giashard.Batches(tree) // shards are numbered like batches
+		if err != nil {
+			log.Fatalf("Error listing shards of %v: %v", tree, err)
+		}
+		for _, shard := range shards {
+			batches, err := giashard.Batches(shard)
+			if err != nil {
+				log.Fatalf("Error listing batches of %v: %v", shard, err)
+			}
+			for _, batch := range batches {
+				redactbatch(batch, rd)
+			}
+		}
+	}
+
+	counts := rd.Counts()
+	names = names[:0]
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Printf("Redacted %d %v", counts[name], name)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/paracrawl/giashard"
+)
+
+// runs a command for each sealed batch, in the background, with the
+// batch's details in the environment and as JSON on stdin. at most jobs
+// commands run at once, sealing waits for one to finish beyond that
+type commandHook struct {
+	command string
+	wg      sync.WaitGroup
+	slots   chan struct{}
+	failed  int64 // commands that failed, atomically
+}
+
+func newCommandHook(command string, jobs int) *commandHook {
+	if jobs < 1 {
+		jobs = 1
+	}
+	return &commandHook{command: command, slots: make(chan struct{}, jobs)}
+}
+
+func (h *commandHook) seal(sb *giashard.SealedBatch) error {
+	buf, err := json.Marshal(sb)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("/bin/sh", "-c", h.command)
+	cmd.Env = append(os.Environ(),
+		"GIASHARD_BATCH="+sb.Path,
+		"GIASHARD_SHARD="+strconv.FormatUint(sb.Shard, 10),
+		"GIASHARD_ROWS="+strconv.FormatInt(sb.Rows, 10),
+		"GIASHARD_COLUMNS="+strings.Join(sb.Columns, ","),
+	)
+	cmd.Stdin = strings.NewReader(string(buf) + "\n")
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	h.slots <- struct{}{}
+	if err = cmd.Start(); err != nil {
+		<-h.slots
+		return err
+	}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		if err := cmd.Wait(); err != nil {
+			log.Printf("Seal command for %v failed: %v", sb.Path, err)
+			atomic.AddInt64(&h.failed, 1)
+		}
+		<-h.slots
+	}()
+	return nil
+}
+
+// wait for the commands still running, returning how many failed in all
+func (h *commandHook) wait() int64 {
+	h.wg.Wait()
+	return atomic.LoadInt64(&h.failed)
+}
+
+// appends a line of JSON for each sealed batch to a spool file
+type spoolHook struct {
+	f *os.File
+}
+
+func newSpoolHook(filename string) (h *spoolHook, err error) {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return
+	}
+	return &spoolHook{f}, nil
+}
+
+func (h *spoolHook) seal(sb *giashard.SealedBatch) error {
+	buf, err := json.Marshal(sb)
+	if err != nil {
+		return err
+	}
+	// a single write, so that readers never see half a line
+	if _, err = h.f.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+	return h.f.Sync()
+}
+
+func (h *spoolHook) close() error {
+	return h.f.Close()
+}
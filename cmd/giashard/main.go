@@ -2,11 +2,13 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/paracrawl/giashard"
@@ -19,17 +21,127 @@ var batchsize int64
 var fileslist string
 var domainList string
 var isjsonl bool
+var cachesize int
+var hotlist string
+var hotsize int64
+var hotk uint
+var planfile string
+var mapfile string
+var pinfile string
+var dryrun bool
+var topk int
+var jsonout bool
+var sample float64
+var samplekey string
+var seed uint64
+var summaryfile string
+var filters stringlist
+var filterfile string
+var dedup string
+var dedupcol string
+var dedupmem int
+var dedupdir string
+var hashcol string
+var indexmode string
+var canonical bool
+var canonkey bool
+var canonrules string
+var capdocs int64
+var capbytes int64
+var caplang string
+var capoverflow string
+var blockfile string
+var normalform string
+var invalidutf8 string
+var keepcontrols bool
+var redact string
+var redactfile string
+var redactcol string
+var sealcmd string
+var sealjobs int
+var spoolfile string
+var buckets uint
+var rowindex int64
+var alignmode string
+var maxrecord int64
+var oversizemode string
+var quarantinedir string
+var level int
+var workers int
+var dictcols string
+var dictsample int64
 
 var schema = []string{"url", "mime", "plain_text"}
 
+// a flag that can be given several times
+type stringlist []string
+
+func (sl *stringlist) String() string {
+	return strings.Join(*sl, "; ")
+}
+
+func (sl *stringlist) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
 func init() {
 	flag.StringVar(&outdir, "o", ".", "Output location")
 	flag.StringVar(&inputslist, "l", "", "Input file listing either directories/files to shard")
-	flag.StringVar(&fileslist, "f", "url,mime,plain_text", "Files to shard, separated by commas (ignored if JSONL)")
+	flag.StringVar(&fileslist, "f", "url,mime,plain_text", "Files to shard, separated by commas, each in=out?default to rename it or make it optional (ignored if JSONL)")
 	flag.UintVar(&shards, "n", 8, "Number of shards (2^n)")
 	flag.Int64Var(&batchsize, "b", 100, "Batch size in MB")
 	flag.StringVar(&domainList, "d", "", "Additional public suffix entries")
 	flag.BoolVar(&isjsonl, "jsonl", false, "Input is in JSONL format (not Paracrawl column storage format)")
+	flag.IntVar(&cachesize, "c", 100000, "Number of hosts to cache slugs for (0 to disable)")
+	flag.StringVar(&hotlist, "hot", "", "File listing hot slugs, one per line, to spread over several shards")
+	flag.Int64Var(&hotsize, "hotsize", 0, "Spread any slug over several shards once it exceeds this many MB (0 to disable)")
+	flag.UintVar(&hotk, "hotk", 4, "Number of shards to spread each hot slug over")
+	flag.StringVar(&planfile, "plan", "", "Scan the inputs first and write a balanced slug map to this file, then shard with it")
+	flag.StringVar(&mapfile, "map", "", "Slug map assigning slugs to shards, falling back to the hash")
+	flag.StringVar(&pinfile, "pins", "", "File pinning slugs or host patterns to fixed shards")
+	flag.BoolVar(&dryrun, "dryrun", false, "Write nothing, just report how rows would be distributed over shards and batches")
+	flag.IntVar(&topk, "top", 10, "Number of largest slugs per shard to report in a dry run")
+	flag.BoolVar(&jsonout, "json", false, "Write the dry run report as JSON")
+	flag.Float64Var(&sample, "sample", 0, "Only keep this fraction of rows, chosen by a seeded hash (0 to keep all)")
+	flag.StringVar(&samplekey, "samplekey", "url", "What to sample by: slug, or a column such as url or id")
+	flag.Uint64Var(&seed, "seed", 0, "Seed for the sampling hash")
+	flag.StringVar(&summaryfile, "summary", "", "Write a summary of the run as JSON to this file")
+	flag.Var(&filters, "filter", "Only keep rows matching this predicate, e.g. 'mime == text/html' (may be repeated)")
+	flag.StringVar(&filterfile, "filterfile", "", "File of predicates, one per line, that rows must match to be kept")
+	flag.StringVar(&dedup, "dedup", "", "Drop rows whose text was already seen in the same shard (shard) or anywhere (global)")
+	flag.StringVar(&dedupcol, "dedupcol", "", "Column holding the text to deduplicate on (default plain_text, or text for JSONL)")
+	flag.IntVar(&dedupmem, "dedupmem", 5000000, "Number of text hashes to keep in memory before spilling to disk")
+	flag.StringVar(&dedupdir, "dedupdir", "", "Directory to spill text hashes to (default the system temporary directory)")
+	flag.StringVar(&hashcol, "hashcol", "", "Also write the text hash to this column when deduplicating")
+	flag.StringVar(&indexmode, "index", "", "Keep a url index per shard, and append, skip or replace rows whose url is already there")
+	flag.BoolVar(&canonical, "canonical", false, "Also write the canonical form of each url to a url_canonical column")
+	flag.BoolVar(&canonkey, "canonkey", false, "Shard by the canonical form of the url rather than the url as it is")
+	flag.StringVar(&canonrules, "canonrules", "", "Canonicalisation rules to apply, separated by commas (default all)")
+	flag.Int64Var(&capdocs, "capdocs", 0, "Keep at most this many documents per slug, chosen by a hash of the url (0 for no limit)")
+	flag.Int64Var(&capbytes, "capbytes", 0, "Keep at most this many MB per slug, chosen by a hash of the url (0 for no limit)")
+	flag.StringVar(&caplang, "caplang", "", "Cap each language of a slug separately, taking the language from this column")
+	flag.StringVar(&capoverflow, "capoverflow", "", "Write rows over the cap to a tree in this directory rather than dropping them")
+	flag.StringVar(&blockfile, "block", "", "Blocklist of domains and url prefixes whose rows are left out")
+	flag.StringVar(&normalform, "normalise", "", "Normalise the text to nfc or nfkc, or none to only repair it (default no text normalisation)")
+	flag.StringVar(&invalidutf8, "invalid", "repair", "When normalising, repair (as Windows-1252), replace or drop invalid UTF-8 in the text")
+	flag.BoolVar(&keepcontrols, "keepcontrols", false, "When normalising, keep control characters in the text")
+	flag.StringVar(&redact, "redact", "", "Redact personal information in the text with these rules, separated by commas, or all ("+strings.Join(giashard.RedactRuleNames(), ", ")+")")
+	flag.StringVar(&redactfile, "redactfile", "", "File of further redaction rules, one name and regular expression per line")
+	flag.StringVar(&redactcol, "redactcol", "", "Also write the number of redactions of each kind in a document to this column")
+	flag.StringVar(&sealcmd, "onseal", "", "Shell command to run in the background as each batch is sealed, given its details in GIASHARD_* variables and as JSON on stdin")
+	flag.IntVar(&sealjobs, "onsealjobs", 4, "Number of -onseal commands to run at once")
+	flag.StringVar(&spoolfile, "spool", "", "Append a line of JSON describing each batch as it is sealed to this file")
+	flag.UintVar(&buckets, "buckets", 0, "Split each shard into this many buckets by a hash of the url, rotating batches within each (0 for none)")
+	flag.Int64Var(&rowindex, "rowindex", 0, "Index the offset of every this many rows in each batch, for random access (0 for no index)")
+	flag.StringVar(&alignmode, "align", "strict", "When input columns have different numbers of rows, fail (strict), stop at the shortest (truncate) or pad the short ones with empty values (pad)")
+	flag.Int64Var(&maxrecord, "maxrecord", 0, "Largest value or JSONL record to read, in MB (0 for no limit)")
+	flag.StringVar(&oversizemode, "oversize", "skip", "What to do with rows over -maxrecord: skip, truncate, or quarantine them")
+	flag.StringVar(&quarantinedir, "quarantine", "", "Where to quarantine rows over -maxrecord (default quarantine in the output directory)")
+	flag.IntVar(&level, "level", 9, "Gzip compression level of the output, from 1 (fastest) to 9 (smallest)")
+	flag.IntVar(&workers, "workers", 0, "Compress the output on this many goroutines shared by all columns (0 or 1 to compress each column as it is written)")
+	flag.StringVar(&dictcols, "dict", "", "Train a zstd dictionary for each of these columns, separated by commas, and compress them with it (e.g. url,mime,source)")
+	flag.Int64Var(&dictsample, "dictsample", 100000, "Number of rows to train dictionaries on, taken from the start of the inputs")
 	flag.Usage = func() {
 		_, err := fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] input directories\n", os.Args[0])
 		if err != nil {
@@ -51,43 +163,111 @@ func init() {
 
 // to deal with two input formats
 type Reader interface {
-	Rows() chan map[string][]byte
+	Next() bool
+	Row() map[string][]byte
+	Err() error
+	Oversized() int64
 	Close() error
 }
 
-func NewReader(source string, schema []string, isjsonl bool) (r Reader, err error) {
+// rows read over the maximum record size, in all inputs
+var oversized int64
+
+// rows over the maximum record size are quarantined in q, if it's given
+func NewReader(source string, schema []string, isjsonl bool, q *giashard.Quarantine) (r Reader, err error) {
+	align, err := giashard.ParseAlignMode(alignmode)
+	if err != nil {
+		return
+	}
+	oversize, err := giashard.ParseOversizeMode(oversizemode)
+	if err != nil {
+		return
+	}
+	if oversize == giashard.OversizeQuarantine && q == nil {
+		oversize = giashard.OversizeSkip
+	}
+
 	if isjsonl {
-		r, err = giashard.NewJsonlReader(source)
+		var jr *giashard.JsonlReader
+		jr, err = giashard.NewJsonlReader(source)
 		if err != nil {
 			return
 		}
+		if maxrecord > 0 {
+			if err = jr.MaxRecord(maxrecord*1024*1024, oversize, q); err != nil {
+				jr.Close()
+				return
+			}
+		}
+		r = jr
 		log.Println("Using JSONL reader")
 	} else {
-		r, err = giashard.NewColumnReader(source, schema...)
+		var cr *giashard.ColumnReader
+		cr, err = giashard.NewColumnReader(source, schema...)
 		if err != nil {
 			return
 		}
+		cr.Align(align)
+		if maxrecord > 0 {
+			cr.MaxRecord(maxrecord*1024*1024, oversize, q)
+		}
+		r = cr
 		log.Println("Using Column reader")
 	}
 
 	return r, nil
 }
 
-func processfile(source string, schema []string, w *giashard.Shard, hostname string, isjsonl bool) {
+// first pass when planning a slug map or capping slugs: look at every row
+// before any are sharded
+// where rows of the input came from, for the source column
+func provenance(hostname string, source string) []byte {
+	return []byte(fmt.Sprintf("%s:%s", hostname, source))
+}
+
+// the current row of r as it is sharded, with provdata from provenance in
+// the source column, so that every pass over the inputs sees the same rows
+func inputRow(r Reader, provdata []byte) map[string][]byte {
+	row := r.Row()
+	row["source"] = provdata
+	return row
+}
+
+func scanfile(source string, schema []string, scan func(row map[string][]byte), hostname string, isjsonl bool) {
+	log.Printf("Scanning input: %v", source)
+	// rows are only quarantined when they are sharded
+	r, err := NewReader(source, schema, isjsonl, nil)
+	if err != nil {
+		log.Fatalf("Error creating Reader: %v", err)
+	}
+
+	provdata := provenance(hostname, source)
+	for r.Next() {
+		scan(inputRow(r, provdata))
+	}
+	if err = r.Err(); err != nil {
+		readerr(source, err)
+	}
+
+	if err = r.Close(); err != nil {
+		log.Printf("Error closing reader: %v", err)
+	}
+}
+
+func processfile(source string, schema []string, w *giashard.Shard, hostname string, isjsonl bool, q *giashard.Quarantine) {
 	log.Printf("Processing input: %v", source)
 	var r Reader
 	var err error
 
-	r, err = NewReader(source, schema, isjsonl)
+	r, err = NewReader(source, schema, isjsonl, q)
 	if err != nil {
 		log.Fatalf("Error creating Reader: %v", err) // err not caught in func
 	}
 
 	// Provenance data tells us origin of a particular output.
-	provdata := []byte(fmt.Sprintf("%s:%s", hostname, source))
-	for row := range r.Rows() {
-		row["source"] = provdata
-		if err := w.WriteRow(row); err != nil {
+	provdata := provenance(hostname, source)
+	for r.Next() {
+		if err := w.WriteRow(inputRow(r, provdata)); err != nil {
 			if errors.Is(err, giashard.ShardError) { // not fatal
 				log.Print(err)
 				continue
@@ -95,6 +275,10 @@ func processfile(source string, schema []string, w *giashard.Shard, hostname str
 			log.Fatalf("Error writing row: %v", err)
 		}
 	}
+	if err = r.Err(); err != nil {
+		readerr(source, err)
+	}
+	oversized += r.Oversized()
 
 	err = r.Close()
 	if err != nil {
@@ -103,6 +287,100 @@ func processfile(source string, schema []string, w *giashard.Shard, hostname str
 	}
 }
 
+// train a dictionary for each of cols on the first rows of the sources,
+// spread evenly over them, and store it in each of the trees that doesn't
+// have one for the column yet
+func traindicts(sources []string, schema []string, cols []string, trees []string, hostname string, isjsonl bool) {
+	var train []string
+	for _, c := range cols {
+		for _, tree := range trees {
+			if giashard.TreeDict(tree, c) == "" {
+				train = append(train, c)
+				break
+			}
+		}
+	}
+	if len(train) == 0 || len(sources) == 0 {
+		return
+	}
+
+	samples := make(map[string][][]byte)
+	per := dictsample / int64(len(sources))
+	if per < 1 {
+		per = 1
+	}
+	for _, source := range sources {
+		if source == "-" {
+			log.Fatalf("Cannot train dictionaries when reading from stdin")
+		}
+		r, err := NewReader(source, schema, isjsonl, nil)
+		if err != nil {
+			log.Fatalf("Error creating Reader: %v", err)
+		}
+		provdata := provenance(hostname, source)
+		for n := int64(0); n < per && r.Next(); n++ {
+			row := inputRow(r, provdata)
+			for _, c := range train {
+				if v := row[c]; len(v) > 0 {
+					samples[c] = append(samples[c], append([]byte{}, v...))
+				}
+			}
+		}
+		if err = r.Err(); err != nil {
+			readerr(source, err)
+		}
+		r.Close()
+	}
+
+	for _, c := range train {
+		if giashard.ConstantLines(samples[c]) {
+			log.Printf("Not training a dictionary for %v: it has the same value in every row sampled", c)
+			continue
+		}
+		d, err := giashard.TrainDict(samples[c], level)
+		if err != nil {
+			log.Printf("Not using a dictionary for %v: %v", c, err)
+			continue
+		}
+		log.Printf("Trained a dictionary of %d bytes for %v on %d lines", len(d), c, len(samples[c]))
+		for _, tree := range trees {
+			if giashard.TreeDict(tree, c) != "" {
+				continue // columns may be written with it already
+			}
+			if err = giashard.WriteDict(tree, c, d); err != nil {
+				log.Fatalf("Error writing dictionary for %v: %v", c, err)
+			}
+		}
+	}
+}
+
+func readerr(source string, err error) {
+	if errors.Is(err, giashard.AlignError) {
+		log.Fatalf("Error reading %v: %v. Use -align truncate or -align pad to shard it anyway", source, err)
+	}
+	log.Fatalf("Error reading %v: %v", source, err)
+}
+
+// read a list of non-empty lines from a file, skipping # comments
+func readlist(filename string) (items []string, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		items = append(items, line)
+	}
+	err = scanner.Err()
+	return
+}
+
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 	flag.Parse()
@@ -121,49 +399,398 @@ func main() {
 		}
 	}
 
-	w, err := giashard.NewShard(outdir, shards, batchsize*1024*1024, "url", append(schema, "source")...)
+	if err := giashard.SetCompression(level, workers); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := giashard.ParseOversizeMode(oversizemode); err != nil {
+		log.Fatal(err)
+	}
+	if oversizemode == "truncate" && isjsonl && maxrecord > 0 {
+		log.Fatalf("JSONL records can't be truncated, use -oversize skip or quarantine")
+	}
+
+	// columns may be renamed and optional, see the README
+	specs, err := giashard.ParseSchema(schema...)
+	if err != nil {
+		log.Fatalf("Error in -f: %v", err)
+	}
+	cols := append(giashard.SchemaColumns(specs), "source")
+	if dedup != "" && hashcol != "" {
+		cols = append(cols, hashcol)
+	}
+	if canonical {
+		cols = append(cols, "url_canonical")
+	}
+	if (redact != "" || redactfile != "") && redactcol != "" {
+		cols = append(cols, redactcol)
+	}
+	// set up before the shards, so that they are only finished with once
+	// the shards are closed
+	var hooks []giashard.SealHook
+	var sealer *commandHook
+	if sealcmd != "" {
+		sealer = newCommandHook(sealcmd, sealjobs)
+		hooks = append(hooks, sealer.seal)
+	}
+	if spoolfile != "" {
+		h, err := newSpoolHook(spoolfile)
+		if err != nil {
+			log.Fatalf("Error opening spool file: %v", err)
+		}
+		defer func() {
+			if err := h.close(); err != nil {
+				log.Printf("Error closing spool file: %v", err)
+			}
+		}()
+		hooks = append(hooks, h.seal)
+	}
+
+	w, err := giashard.NewShard(outdir, shards, batchsize*1024*1024, "url", cols...)
 	if err != nil {
 		log.Fatalf("Error opening output shards: %v", err)
 	}
-	defer func(w *giashard.Shard) {
-		var err = w.Close()
+
+	if buckets > 0 {
+		if err = w.Buckets(buckets); err != nil {
+			log.Fatalf("Error setting up buckets: %v", err)
+		}
+	}
+	if rowindex > 0 {
+		w.RowIndex(rowindex)
+	}
+
+	if len(hooks) > 0 {
+		w.OnSeal(func(sb *giashard.SealedBatch) error {
+			for _, hook := range hooks {
+				if err := hook(sb); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	var canon *giashard.Canonicaliser
+	if canonical || canonkey {
+		var rules []string
+		if canonrules != "" {
+			rules = strings.Split(canonrules, ",")
+		}
+		if canon, err = giashard.NewCanonicaliser(rules...); err != nil {
+			log.Fatalf("Error setting up canonicalisation: %v", err)
+		}
+	}
+	if canonical {
+		w.Transform(giashard.NewCanonicalColumn(canon, "url", "url_canonical"))
+	}
+	if normalform != "" {
+		mode, err := giashard.ParseInvalidMode(invalidutf8)
+		if err != nil {
+			log.Fatal(err)
+		}
+		textcol := "plain_text"
+		if isjsonl {
+			textcol = "text"
+		}
+		n, err := giashard.NewNormaliser(textcol, normalform, mode, !keepcontrols)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Transform(n)
+	}
+	if redact != "" || redactfile != "" {
+		var rules []*giashard.RedactRule
+		if redact != "" {
+			var names []string
+			if redact != "all" {
+				names = strings.Split(redact, ",")
+			}
+			if rules, err = giashard.RedactRules(names...); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if redactfile != "" {
+			more, err := giashard.ReadRedactRules(redactfile)
+			if err != nil {
+				log.Fatalf("Error reading redaction rules: %v", err)
+			}
+			rules = append(rules, more...)
+		}
+		textcol := "plain_text"
+		if isjsonl {
+			textcol = "text"
+		}
+		rd := giashard.NewRedactor(textcol, rules...)
+		if redactcol != "" {
+			rd.CountColumn(redactcol)
+		}
+		w.Transform(rd)
+	}
+	if canonkey {
+		if err = w.CanonicaliseKey(canon); err != nil {
+			log.Fatalf("Error setting up canonicalisation: %v", err)
+		}
+	}
+
+	var dist *giashard.Distribution
+	if dryrun {
+		dist = w.DryRun()
+	}
+
+	if blockfile != "" {
+		bl, err := giashard.ReadBlocklist(blockfile)
 		if err != nil {
+			log.Fatalf("Error reading blocklist: %v", err)
+		}
+		w.Block(bl)
+		log.Printf("Blocking %d domains and url prefixes", len(bl.Entries()))
+	}
 
+	if filterfile != "" {
+		more, err := readlist(filterfile)
+		if err != nil {
+			log.Fatalf("Error reading filters: %v", err)
+		}
+		filters = append(filters, more...)
+	}
+	if len(filters) > 0 {
+		f, err := giashard.NewFilter(filters...)
+		if err != nil {
+			log.Fatalf("Error setting up filter: %v", err)
 		}
-	}(w)
+		w.Filter(f)
+	}
+
+	if dedup != "" {
+		if dedup != "shard" && dedup != "global" {
+			log.Fatalf("Unknown deduplication mode %v, expected shard or global", dedup)
+		}
+		if dedupcol == "" {
+			dedupcol = "plain_text"
+			if isjsonl {
+				dedupcol = "text"
+			}
+		}
+		d := giashard.NewDeduper(dedupcol, dedup == "global", dedupmem, dedupdir)
+		if hashcol != "" {
+			d.HashColumn(hashcol)
+		}
+		w.Dedup(d)
+	}
+
+	if indexmode != "" {
+		mode, err := giashard.ParseIndexMode(indexmode)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.Index(mode)
+	}
+
+	if sample > 0 {
+		sp, err := giashard.NewSampler(samplekey, sample, seed)
+		if err != nil {
+			log.Fatalf("Error setting up sampling: %v", err)
+		}
+		if err = w.Sample(sp); err != nil {
+			log.Fatalf("Error setting up sampling: %v", err)
+		}
+	}
+
+	if pinfile != "" {
+		pins, err := giashard.ReadPins(pinfile)
+		if err != nil {
+			log.Fatalf("Error reading pins: %v", err)
+		}
+		if err = w.Pin(pins...); err != nil {
+			log.Fatalf("Error pinning shards: %v", err)
+		}
+		log.Printf("Pinned %d slugs or hosts to fixed shards", len(pins))
+	}
+
+	if hotlist != "" {
+		slugs, err := readlist(hotlist)
+		if err != nil {
+			log.Fatalf("Error reading hot slugs: %v", err)
+		}
+		w.SplitSlugs(hotk, slugs...)
+		log.Printf("Spreading %d hot slugs over %d shards each", len(slugs), hotk)
+	}
+	if hotsize > 0 {
+		w.SplitThreshold(hotsize*1024*1024, hotk)
+	}
+
+	var cache *giashard.SlugCache
+	if cachesize > 0 {
+		cache = w.CacheSlugs(cachesize)
+		defer func() {
+			log.Printf("Slug cache: %v", cache.Stats())
+		}()
+	}
 
 	hostname, err := os.Hostname() // returns hostname reported by the kernel
 	if err != nil {
 		log.Fatalf("Error getting local hostname: %v", err)
 	}
 
-	// process files given as arguments
-	for i := 0; i < flag.NArg(); i++ {
-		source := flag.Arg(i)
-		processfile(source, schema, w, hostname, isjsonl)
-	}
-
-	// read in inputs from text file if specified
+	// inputs are given as arguments, and read in from text file if specified
+	sources := flag.Args()
 	if inputslist != "" {
-		file, err := os.Open(inputslist)
+		more, err := readlist(inputslist)
 		if err != nil {
 			log.Fatal(err)
 		}
-		defer func(file *os.File) {
-			var err = file.Close()
+		sources = append(sources, more...)
+	}
+
+	if dictcols != "" && !dryrun {
+		// only the columns as read can be sampled
+		read := make(map[string]bool)
+		for _, c := range append(giashard.SchemaColumns(specs), "source") {
+			read[c] = true
+		}
+		dcols := strings.Split(dictcols, ",")
+		for _, c := range dcols {
+			if !read[c] {
+				log.Fatalf("Cannot train a dictionary for %v, it is not a column of the input or source", c)
+			}
+		}
+		trees := []string{outdir}
+		if capoverflow != "" {
+			trees = append(trees, capoverflow)
+		}
+		traindicts(sources, schema, dcols, trees, hostname, isjsonl)
+	}
+
+	var sizes giashard.SlugSizes
+	if planfile != "" {
+		sizes = make(giashard.SlugSizes)
+	}
+	var capper *giashard.Capper
+	var overflow *giashard.Shard
+	if capdocs > 0 || capbytes > 0 {
+		capper = giashard.NewCapper(capdocs, capbytes*1024*1024, caplang)
+		if capoverflow != "" && !dryrun {
+			if overflow, err = giashard.NewShard(capoverflow, shards, batchsize*1024*1024, "url", cols...); err != nil {
+				log.Fatalf("Error opening overflow shards: %v", err)
+			}
+		}
+		w.Cap(capper, overflow)
+	}
+
+	if sizes != nil || capper != nil {
+		slug := giashard.Slug
+		if cache != nil {
+			slug = cache.Slug
+		}
+		if canonkey {
+			bare := slug
+			slug = func(key string) (string, error) {
+				return bare(canon.Canonicalise(key))
+			}
+		}
+		scan := func(row map[string][]byte) {
+			w.ScanRow(row)
+			if sizes == nil {
+				return
+			}
+			s, err := slug(string(row["url"]))
 			if err != nil {
+				return // reported when sharding
+			}
+			sizes.Add(s, row)
+		}
+		for _, source := range sources {
+			if source == "-" {
+				log.Fatalf("Cannot plan a slug map or cap slugs when reading from stdin")
+			}
+			scanfile(source, schema, scan, hostname, isjsonl)
+		}
+	}
 
+	if planfile != "" {
+		sm := giashard.PackSlugs(sizes, shards)
+		if dryrun {
+			// a dry run reports on the plan without writing it
+			log.Printf("Planned slug map for %d slugs, not written in a dry run", len(sm))
+			if err := w.UseSlugMap(sm); err != nil {
+				log.Fatalf("Error using planned slug map: %v", err)
+			}
+		} else {
+			if err := sm.Write(planfile); err != nil {
+				log.Fatalf("Error writing slug map: %v", err)
 			}
-		}(file)
+			log.Printf("Planned slug map for %d slugs in %v", len(sm), planfile)
+			mapfile = planfile
+		}
+	}
 
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			source := scanner.Text()
-			processfile(source, schema, w, hostname, isjsonl)
+	if mapfile != "" {
+		sm, err := giashard.ReadSlugMap(mapfile)
+		if err != nil {
+			log.Fatalf("Error reading slug map: %v", err)
+		}
+		if err = w.UseSlugMap(sm); err != nil {
+			log.Fatalf("Error using slug map %v: %v", mapfile, err)
 		}
+	}
 
-		if err := scanner.Err(); err != nil {
-			log.Fatal(err)
+	var quarantine *giashard.Quarantine
+	if maxrecord > 0 && oversizemode == "quarantine" && !dryrun {
+		if quarantinedir == "" {
+			quarantinedir = filepath.Join(outdir, "quarantine")
+		}
+		if quarantine, err = giashard.NewQuarantine(quarantinedir); err != nil {
+			log.Fatalf("Error opening quarantine: %v", err)
+		}
+		defer quarantine.Close()
+	}
+
+	for _, source := range sources {
+		processfile(source, schema, w, hostname, isjsonl, quarantine)
+	}
+
+	// closing seals the last batches, removes replaced rows and writes the
+	// indexes and the manifest, any of which can fail
+	if err = w.Close(); err != nil {
+		log.Fatalf("Error closing output shards: %v", err)
+	}
+	if overflow != nil {
+		if err = overflow.Close(); err != nil {
+			log.Fatalf("Error closing overflow shards: %v", err)
+		}
+	}
+
+	summary := w.Summary()
+	summary.Oversized = oversized
+	log.Printf("Summary: %v", summary)
+	if capper != nil {
+		log.Printf("Capped %d rows from %d slugs", summary.Capped, capper.Capped())
+	}
+	for _, expr := range filters {
+		log.Printf("Filter %q rejected %d rows", expr, summary.Filters[strings.TrimSpace(expr)])
+	}
+	if summaryfile != "" {
+		if err = summary.Write(summaryfile); err != nil {
+			log.Fatalf("Error writing summary: %v", err)
+		}
+	}
+
+	if dist != nil {
+		report := dist.Report(topk)
+		if jsonout {
+			err = json.NewEncoder(os.Stdout).Encode(report)
+		} else {
+			err = report.Print(os.Stdout)
+		}
+		if err != nil {
+			log.Fatalf("Error writing dry run report: %v", err)
+		}
+	}
+
+	// the shards are closed, so no more commands are started
+	if sealer != nil {
+		if failed := sealer.wait(); failed > 0 {
+			log.Fatalf("%d seal commands failed", failed)
 		}
 	}
 }
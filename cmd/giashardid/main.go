@@ -6,17 +6,31 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"github.com/paracrawl/giashard"
 )
 
 var shards uint
 var slugs bool
 var domainList string
+var tree string
+var all bool
+var mapfile string
+var pinfile string
+var bucket bool
+var buckets uint
 
 func init() {
 	flag.UintVar(&shards, "n", 8, "Number of shards (2^n)")
 	flag.BoolVar(&slugs, "s", false, "Print slugs instead of shards")
 	flag.StringVar(&domainList, "d", "", "Additional public suffix entries")
+	flag.StringVar(&tree, "t", "", "Sharded tree whose manifest to use (overrides -n)")
+	flag.StringVar(&mapfile, "m", "", "Slug map assigning slugs to shards")
+	flag.StringVar(&pinfile, "p", "", "File pinning slugs or host patterns to fixed shards")
+	flag.BoolVar(&all, "a", false, "Print every shard the domain may live in, separated by spaces")
+	flag.BoolVar(&bucket, "b", false, "Also print the bucket within the shard, after a tab")
+	flag.UintVar(&buckets, "k", 0, "Number of buckets per shard (overridden by the tree's manifest)")
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [url]\n", os.Args[0])
 		flag.PrintDefaults()
@@ -58,19 +72,65 @@ func main() {
 		}
 	}
 
+	manifest := giashard.NewManifest(shards, "url")
+	if tree != "" {
+		var err error
+		manifest, err = giashard.ReadManifest(tree)
+		if err != nil {
+			log.Fatalf("Error reading manifest: %v", err)
+		}
+	}
+	if buckets > 0 && manifest.Buckets == 0 {
+		if err := manifest.SetBuckets(buckets); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if mapfile != "" {
+		sm, err := giashard.ReadSlugMap(mapfile)
+		if err != nil {
+			log.Fatalf("Error reading slug map: %v", err)
+		}
+		if err = manifest.UseSlugMap(sm); err != nil {
+			log.Fatalf("Error using slug map: %v", err)
+		}
+	}
+	if pinfile != "" {
+		pins, err := giashard.ReadPins(pinfile)
+		if err != nil {
+			log.Fatalf("Error reading pins: %v", err)
+		}
+		if err = manifest.Pin(pins...); err != nil {
+			log.Fatalf("Error pinning shards: %v", err)
+		}
+	}
+
 	for url := range urls() {
+		suffix := ""
+		if bucket {
+			suffix = "\t" + strconv.FormatUint(uint64(manifest.Bucket(url)), 10)
+		}
 		if slugs {
 			slug, err := giashard.Slug(url)
 			if err != nil {
 				log.Fatalf("Error computing slug: %v", err)
 			}
 			fmt.Println(slug)
+		} else if all {
+			ids, err := manifest.ShardIds(url)
+			if err != nil {
+				log.Fatalf("Error computing shard ids: %v", err)
+			}
+			strs := make([]string, 0, len(ids))
+			for _, id := range ids {
+				strs = append(strs, strconv.FormatUint(id, 10))
+			}
+			fmt.Println(strings.Join(strs, " ") + suffix)
 		} else {
-			shard, err := giashard.ShardId(url, shards)
+			shard, err := manifest.ShardId(url)
 			if err != nil {
 				log.Fatalf("Error computing shard id: %v", err)
 			}
-			fmt.Println(shard)
+			fmt.Println(strconv.FormatUint(shard, 10) + suffix)
 		}
 	}
 }
@@ -14,12 +14,14 @@ var calculate bool
 var write bool
 var summary bool
 var jsonout bool
+var verify bool
 
 func init() {
 	flag.BoolVar(&calculate, "c", false, "Force recalculation of statistics")
 	flag.BoolVar(&write, "w", false, "Write statistics to shard")
 	flag.BoolVar(&summary, "s", false, "Write summary health statistics to stdout")
 	flag.BoolVar(&jsonout, "j", false, "Write output in json (as opposed to yaml)")
+	flag.BoolVar(&verify, "v", false, "Check the shard against its metadata sidecar")
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] shard\n", os.Args[0])
 		flag.PrintDefaults()
@@ -38,6 +40,13 @@ func main() {
 
 	shard := flag.Arg(0)
 
+	if verify {
+		if err := giashard.VerifyBatch(shard); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%v matches its metadata", shard)
+	}
+
 	var stats *giashard.ShardStats
 	var err error
 
@@ -46,12 +55,20 @@ func main() {
 		stats.Calc()
 	} else {
 		stats, err = giashard.ReadStats(shard)
+		if os.IsNotExist(err) {
+			// fall back to the metadata written when the batch was sealed
+			stats, err = giashard.StatsFromMeta(shard)
+		}
 		if err != nil {
 			log.Fatalf("error reading stats: %v", err)
 			stats = giashard.NewStats(shard)
 		}
 	}
 
+	if err = stats.Aligned(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
 	var marshaller func (interface {}) ([]byte, error)
 	if jsonout {
 		marshaller = json.Marshal
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/paracrawl/giashard"
+)
+
+var blockfile string
+var auditfile string
+var dryrun bool
+
+func init() {
+	flag.StringVar(&blockfile, "b", "", "Blocklist of domains and url prefixes to remove")
+	flag.StringVar(&auditfile, "log", "", "Audit log to append the removed rows to (default takedown.log in each tree)")
+	flag.BoolVar(&dryrun, "dryrun", false, "Only log the rows that would be removed, leaving the batches as they are")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] tree directories\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), `Removes the rows matching a blocklist from sharded trees. The tree's manifest
+is used to find the shards the blocked domains can be in, and only batches
+that contain blocked rows are rewritten, with every column kept aligned.
+Each removed row is appended to the audit log as a tab separated line of
+time, batch, row number, url and the blocklist entry that matched.
+`)
+	}
+}
+
+type audit struct {
+	w   *bufio.Writer
+	now string
+}
+
+func (a *audit) log(batch string, row int64, url []byte, entry string) {
+	fmt.Fprintf(a.w, "%s\t%s\t%d\t%s\t%s\n", a.now, batch, row, url, entry)
+}
+
+// the blocked rows of a batch, and the entries that matched them
+func findrows(batch string, key string, bl *giashard.Blocklist) (rows map[int64]string, urls map[int64][]byte) {
+	r, err := giashard.NewColumnReader(batch, key)
+	if err != nil {
+		log.Fatalf("Error reading %v: %v", batch, err)
+	}
+	rows, urls = make(map[int64]string), make(map[int64][]byte)
+	i := int64(0)
+	for r.Next() {
+		url := r.Row()[key]
+		if entry, ok := bl.Match(string(url)); ok {
+			rows[i], urls[i] = entry, append([]byte{}, url...)
+		}
+		i++
+	}
+	if err = r.Err(); err != nil {
+		log.Fatalf("Error reading %v: %v", batch, err)
+	}
+	if err = r.Close(); err != nil {
+		log.Printf("Error closing %v: %v", batch, err)
+	}
+	return
+}
+
+// remove the blocked rows from one shard, returning how many there were
+func takedown(shard string, key string, bl *giashard.Blocklist, a *audit) (removed int64) {
+	batches, err := giashard.Batches(shard)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return // nothing was ever written to this shard
+		}
+		log.Fatalf("Error listing batches of %v: %v", shard, err)
+	}
+
+	for _, batch := range batches {
+		rows, urls := findrows(batch, key, bl)
+		if len(rows) == 0 {
+			continue
+		}
+		if !dryrun {
+			cols, err := giashard.BatchColumns(batch)
+			if err != nil {
+				log.Fatalf("Error listing columns of %v: %v", batch, err)
+			}
+			_, dropped, err := giashard.RewriteBatch(batch, cols, func(i int64, row map[string][]byte) (bool, error) {
+				_, blocked := rows[i]
+				return !blocked, nil
+			})
+			if err != nil {
+				log.Fatalf("Error rewriting %v: %v", batch, err)
+			}
+			log.Printf("Batch %v: removed %d rows", batch, dropped)
+		}
+
+		numbers := make([]int64, 0, len(rows))
+		for i := range rows {
+			numbers = append(numbers, i)
+		}
+		sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+		for _, i := range numbers {
+			a.log(batch, i, urls[i], rows[i])
+		}
+		removed += int64(len(rows))
+	}
+
+	// row numbers have changed, so have the url index rebuilt when next needed
+	if removed > 0 && !dryrun {
+		idx := filepath.Join(shard, giashard.URLIndexName)
+		if err := os.Remove(idx); err != nil && !os.IsNotExist(err) {
+			log.Fatalf("Error removing outdated url index %v: %v", idx, err)
+		}
+	}
+	return
+}
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	flag.Parse()
+
+	if flag.NArg() == 0 || blockfile == "" {
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	bl, err := giashard.ReadBlocklist(blockfile)
+	if err != nil {
+		log.Fatalf("Error reading blocklist: %v", err)
+	}
+
+	for _, tree := range flag.Args() {
+		m, err := giashard.ReadManifest(tree)
+		if err != nil {
+			log.Fatalf("Error reading manifest: %v", err)
+		}
+		shards, err := bl.Shards(m)
+		if err != nil {
+			log.Fatalf("Error finding shards for %v: %v", tree, err)
+		}
+		log.Printf("Tree %v: checking %d of %d shards", tree, len(shards), 1<<m.Shards)
+
+		fname := auditfile
+		if fname == "" {
+			fname = filepath.Join(tree, "takedown.log")
+		}
+		f, err := os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			log.Fatalf("Error opening audit log: %v", err)
+		}
+		a := &audit{bufio.NewWriter(f), time.Now().UTC().Format(time.RFC3339)}
+
+		total := int64(0)
+		for _, id := range shards {
+			total += takedown(filepath.Join(tree, strconv.FormatUint(id, 10)), m.Key, bl, a)
+		}
+		if err = a.w.Flush(); err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			log.Fatalf("Error writing audit log: %v", err)
+		}
+		log.Printf("Tree %v: removed %d rows, logged to %v", tree, total, fname)
+	}
+}
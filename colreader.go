@@ -1,34 +1,48 @@
 package giashard
 
 import (
+	"fmt"
 	"log"
-	"path/filepath"
 )
 
 // read columns of compressed files containing lines
 type ColumnReader struct {
+	dir string
+	names []string // the files read, for each column
 	cols []string
 	readers []*LineReader
+	row map[string][]byte // the current row, reused
+	err error
+	align AlignMode  // what to do if columns end at different rows
+	ended []bool     // which columns have ended
+	counts []int64   // rows read from each column
+	done bool
+	fill map[string][]byte // values of optional columns that are missing
+	lim recordLimit        // what to do with rows that are too long
+}
+
+func newColumnReader(dir string, cols []string, readers []*LineReader) *ColumnReader {
+	return &ColumnReader{
+		dir: dir,
+		names: cols,
+		cols: cols,
+		readers: readers,
+		row: make(map[string][]byte, len(cols)),
+		align: AlignStrict,
+		ended: make([]bool, len(cols)),
+		counts: make([]int64, len(cols)),
+	}
 }
 
 // make new column reader for the given directory, which is assumed to have
-// files name c1.gz, c2.gz, ... for each element of cols
+// files name c1.gz, c2.gz, ... for each element of cols. columns may be
+// renamed and made optional, as described in schema.go
 func NewColumnReader(dir string, cols ...string) (r *ColumnReader, err error) {
-	readers := make([]*LineReader, 0, len(cols))
-	for _, c := range cols {
-		lr, err := NewLineReader(filepath.Join(dir, c + ".gz"))
-		if err != nil {
-			for _, lr := range readers {
-				if e := lr.Close(); e != nil {
-					log.Print(e)
-				}
-			}
-			return nil, err
-		}
-		readers = append(readers, lr)
+	schema, err := ParseSchema(cols...)
+	if err != nil {
+		return
 	}
-	r = &ColumnReader{cols, readers}
-	return
+	return NewSchemaReader(dir, schema...)
 }
 
 // close the underlying readers
@@ -41,28 +55,90 @@ func (r *ColumnReader)Close() (err error) {
 	return
 }
 
+// send rows to the channel. this is a wrapper around Next, copying each
+// row
 func (r *ColumnReader)Rows() (ch chan map[string][]byte) {
 	ch = make(chan map[string][]byte)
-
-	srcs := make([]chan []byte, 0, len(r.cols))
-	for _, lr := range r.readers {
-		srcs = append(srcs, lr.Lines())
-	}
-
 	go func() {
-		for {
-			m := make(map[string][]byte)
-			for i, c := range(r.cols) {
-				v, ok := <- srcs[i]
-				if !ok {
-					close(ch)
-					return
-				}
-				m[c] = v
+		for r.Next() {
+			m := make(map[string][]byte, len(r.row))
+			for c, v := range r.row {
+				item := make([]byte, len(v))
+				copy(item, v)
+				m[c] = item
 			}
 			ch <- m
 		}
+		if err := r.Err(); err != nil && !closedEarly(err) {
+			log.Fatalf("error reading column: %v", err)
+		}
+		close(ch)
 	}()
 
 	return ch
 }
+
+// read the next row, returning false when the columns end or on an
+// error, which Err then gives. columns that end at different rows are
+// an *AlignErr, unless the reader was told otherwise with Align. rows
+// with values that are too long are dealt with as MaxRecord says
+func (r *ColumnReader)Next() bool {
+	for r.next() {
+		if !r.oversized() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ColumnReader)next() bool {
+	if r.err != nil || r.done {
+		return false
+	}
+	for c := range r.row {
+		delete(r.row, c)
+	}
+	ended := 0
+	for i, lr := range r.readers {
+		if !r.ended[i] && lr.Next() {
+			r.row[r.cols[i]] = lr.Line()
+			r.counts[i]++
+			continue
+		}
+		if err := lr.Err(); err != nil {
+			r.err = fmt.Errorf("column %v: %w", r.names[i], err)
+			return false
+		}
+		r.ended[i] = true
+		r.row[r.cols[i]] = []byte{}
+		ended++
+	}
+	for c, v := range r.fill {
+		r.row[c] = v
+	}
+	switch {
+	case ended == 0:
+		return true
+	case ended == len(r.readers):
+		r.done = true
+		if r.align == AlignPad {
+			r.padded()
+		}
+		return false
+	case r.misaligned():
+		return true
+	default:
+		r.done = true
+		return false
+	}
+}
+
+// the row read by Next. the map and its values are reused, and are only
+// good until the next call to Next
+func (r *ColumnReader)Row() map[string][]byte {
+	return r.row
+}
+
+func (r *ColumnReader)Err() error {
+	return r.err
+}
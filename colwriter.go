@@ -1,22 +1,31 @@
 package giashard
 
 import (
+	"fmt"
 	"log"
+	"os"
 	"path/filepath"
 )
 
 // read columns of compressed files containing lines
 type ColumnWriter struct {
+	dir string
 	cols []string
 	writers []*LineWriter
+	index *os.File // row index, if rows are indexed
+	every int64    // rows between index entries
+	row int64      // number of the next row in the batch
+	last int64     // row of the last index entry, 0 if none
+	written int64  // rows written through this writer
 }
 
 // make new column reader for the given directory, which is assumed to have
-// files name c1.gz, c2.gz, ... for each element of cols
+// files name c1.gz, c2.gz, ... for each element of cols, or c1.zst and
+// so on for columns the tree has a dictionary for, see dict.go
 func NewColumnWriter(dir string, cols ...string) (w *ColumnWriter, err error) {
 	writers := make([]*LineWriter, 0, len(cols))
 	for _, c := range cols {
-		lw, err := NewLineWriter(filepath.Join(dir, c + ".gz"))
+		lw, err := NewLineWriter(ColumnOutputFile(dir, c))
 		if err != nil {
 			for _, lw := range writers {
 				if e := lw.Close(); e != nil {
@@ -27,12 +36,17 @@ func NewColumnWriter(dir string, cols ...string) (w *ColumnWriter, err error) {
 		}
 		writers = append(writers, lw)
 	}
-	w = &ColumnWriter{cols, writers}
+	w = &ColumnWriter{dir: dir, cols: cols, writers: writers}
 	return
 }
 
 // close the underlying readers
 func (w *ColumnWriter)Close() (err error) {
+	if w.index != nil {
+		if e := w.index.Close(); e != nil {
+			err = e
+		}
+	}
 	for _, lw := range w.writers {
 		if e := lw.Close(); e != nil {
 			err = e
@@ -42,6 +56,12 @@ func (w *ColumnWriter)Close() (err error) {
 }
 
 func (w *ColumnWriter)WriteRow(row map[string][]byte) (err error) {
+	// unless the member was started already, on appending to the batch
+	if w.index != nil && w.row > 0 && w.row % w.every == 0 && w.row != w.last {
+		if err = w.checkpoint(); err != nil {
+			return
+		}
+	}
 	for i, c := range(w.cols) {
 		e := w.writers[i].WriteLine(row[c])
 		if e != nil {
@@ -49,5 +69,119 @@ func (w *ColumnWriter)WriteRow(row map[string][]byte) (err error) {
 			return
 		}
 	}
+	w.row += 1
+	w.written += 1
+	return
+}
+
+// the number of uncompressed bytes written to each column
+func (w *ColumnWriter)Sizes() (sizes []int64) {
+	for _, lw := range w.writers {
+		sizes = append(sizes, lw.Size())
+	}
+	return
+}
+
+// describe the columns from what was written to them once the writer is
+// closed, given the metadata of the batch as it was before, if any. a
+// column that was not as old describes it is left out
+func (w *ColumnWriter)meta(old *BatchMeta) (cols map[string]ColumnMeta) {
+	cols = make(map[string]ColumnMeta)
+	for i, c := range w.cols {
+		var prior ColumnMeta
+		if old != nil {
+			prior = old.Columns[c]
+		}
+		if cm, ok := w.writers[i].meta(prior); ok {
+			cols[c] = cm
+		}
+	}
 	return
 }
+
+// keep a row index for the batch, with an entry every so many rows.
+// start is the number of rows already in the batch, and the entries
+// of an index already there are kept if they agree with it
+func (w *ColumnWriter)IndexRows(every int64, start int64) (err error) {
+	if every < 1 {
+		return fmt.Errorf("rows must be indexed at least every row, not every %d", every)
+	}
+	if w.index != nil {
+		return fmt.Errorf("rows of %v are already indexed", w.dir)
+	}
+	w.every = every
+	w.row = start
+
+	ix := &RowIndex{Every: every, Cols: w.cols}
+	fname := filepath.Join(w.dir, RowIndexName)
+	old, err := ReadRowIndex(w.dir)
+	fresh := err != nil
+	if err == nil {
+		fresh = old.Every != every || !sameColumns(old.Cols, w.cols)
+		// offsets are only compared for the same columns
+		if row, offsets := old.last(); !fresh && row > start {
+			fresh = true
+		} else if !fresh {
+			for i, lw := range w.writers {
+				if offsets[i] > lw.off {
+					fresh = true
+				}
+			}
+		}
+		if fresh {
+			log.Printf("Row index of %v does not match the batch, starting it again", w.dir)
+		} else {
+			ix = old
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("Error reading row index of %v, starting it again: %v", w.dir, err)
+	}
+
+	flags := os.O_APPEND|os.O_CREATE|os.O_WRONLY
+	if fresh {
+		flags |= os.O_TRUNC
+	}
+	if w.index, err = os.OpenFile(fname, flags, 0666); err != nil {
+		return
+	}
+	if fresh {
+		if _, err = w.index.WriteString(ix.header()); err != nil {
+			return
+		}
+	}
+	// rows appended to the batch start in a member of their own
+	w.last, _ = ix.last()
+	if start > 0 && start != w.last {
+		err = w.checkpoint()
+	}
+	return
+}
+
+// start a new gzip member in every column, and record where they start
+func (w *ColumnWriter)checkpoint() (err error) {
+	offsets := make([]int64, len(w.writers))
+	for i, lw := range w.writers {
+		if w.written == 0 {
+			// nothing written yet, the next member starts at the end
+			offsets[i] = lw.off
+		} else if offsets[i], err = lw.NewMember(); err != nil {
+			return
+		}
+	}
+	if _, err = w.index.WriteString(formatRowIndexEntry(w.row, offsets)); err == nil {
+		w.last = w.row
+	}
+	return
+}
+
+func sameColumns(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
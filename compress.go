@@ -0,0 +1,210 @@
+package giashard
+
+/*
+By default each column is compressed as it is written, on the goroutine
+writing it. With SetCompression(level, workers), for workers > 1, line
+writers instead gather lines into blocks and hand them to a pool of
+workers shared by every writer, each block being compressed as a gzip
+member of its own. A file of several members decompresses to the same
+lines as one, so the output is a standard gzip file either way.
+
+Memory is bounded by the pool as a whole rather than by the writer, as a
+tree may have thousands of batches open at once. At most two blocks per
+worker are being compressed or waiting to be written out, and writers
+hold at most maxBuffered bytes of lines between them, the writer that
+goes over sending its block off early.
+
+A pool replaced by SetCompression carries on for the writers that have
+it, and its workers stop once the last of them is closed.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	kgzip "github.com/klauspost/compress/gzip"
+)
+
+const (
+	blockSize   = 1 << 20   // lines to gather before compressing them
+	maxBuffered = 256 << 20 // lines gathered by all writers together
+)
+
+type compressJob struct {
+	in   []byte
+	out  bytes.Buffer
+	err  error
+	done chan struct{}
+}
+
+type compressPool struct {
+	level    int
+	jobs     chan *compressJob
+	slots    chan struct{} // one for each block in flight
+	buffered int64         // bytes gathered by writers, atomically
+	writers  int           // writers using the pool, under compression's lock
+	retired  bool          // replaced, to be closed with its last writer
+}
+
+var compression = struct {
+	sync.Mutex
+	level int
+	pool  *compressPool
+}{level: 9}
+
+// compress columns at the given gzip level, from 1 to 9, on workers
+// goroutines shared by all line writers opened from now on. 1 or fewer
+// workers compresses each column on the goroutine writing it
+func SetCompression(level int, workers int) (err error) {
+	if level < 1 || level > 9 {
+		return fmt.Errorf("compression level must be from 1 to 9, not %d", level)
+	}
+	compression.Lock()
+	defer compression.Unlock()
+	// writers already open keep the pool they have
+	if old := compression.pool; old != nil {
+		old.retired = true
+		if old.writers == 0 {
+			close(old.jobs)
+		}
+	}
+	compression.level, compression.pool = level, nil
+	if workers > 1 {
+		compression.pool = newCompressPool(level, workers)
+	}
+	return
+}
+
+// the compression for a new line writer, and the pool if it is to use one,
+// which counts it among its writers until it leaves
+func joinCompression(zst bool) (level int, pool *compressPool) {
+	compression.Lock()
+	defer compression.Unlock()
+	if zst || compression.pool == nil {
+		return compression.level, nil
+	}
+	compression.pool.writers++
+	return compression.level, compression.pool
+}
+
+// a writer is done with the pool
+func (p *compressPool) leave() {
+	compression.Lock()
+	defer compression.Unlock()
+	p.writers--
+	if p.retired && p.writers == 0 {
+		close(p.jobs)
+	}
+}
+
+func newCompressPool(level int, workers int) *compressPool {
+	p := &compressPool{
+		level: level,
+		jobs:  make(chan *compressJob),
+		slots: make(chan struct{}, 2*workers),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *compressPool) work() {
+	z, _ := kgzip.NewWriterLevel(nil, p.level)
+	for job := range p.jobs {
+		z.Reset(&job.out)
+		z.Comment = "Written by giashard"
+		if _, job.err = z.Write(job.in); job.err == nil {
+			job.err = z.Close()
+		}
+		atomic.AddInt64(&p.buffered, -int64(len(job.in)))
+		job.in = nil
+		close(job.done)
+	}
+}
+
+// the blocks of one line writer, compressed by the pool and written out
+// in order
+type parallelWriter struct {
+	pool  *compressPool
+	buf   []byte
+	queue chan *compressJob
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	err   error // the first error writing out, under mu
+	wrote bool  // whether any block was sent
+	out   func(p []byte) (int, error)
+}
+
+func newParallelWriter(pool *compressPool, out func(p []byte) (int, error)) *parallelWriter {
+	pw := &parallelWriter{pool: pool, queue: make(chan *compressJob, 4), out: out}
+	go pw.drain()
+	return pw
+}
+
+func (pw *parallelWriter) drain() {
+	for job := range pw.queue {
+		<-job.done
+		if job.err == nil && pw.failed() == nil {
+			_, job.err = pw.out(job.out.Bytes())
+		}
+		pw.mu.Lock()
+		if job.err != nil && pw.err == nil {
+			pw.err = job.err
+		}
+		pw.mu.Unlock()
+		<-pw.pool.slots
+		pw.wg.Done()
+	}
+}
+
+// the first error writing out so far, if any
+func (pw *parallelWriter) failed() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.err
+}
+
+// lines are gathered in a buffer that grows as they are added, so that
+// writers that are sent few rows don't hold a block each. an error from
+// an earlier block is returned once it has been written out
+func (pw *parallelWriter) write(line []byte) error {
+	pw.buf = append(pw.buf, line...)
+	total := atomic.AddInt64(&pw.pool.buffered, int64(len(line)))
+	if len(pw.buf) >= blockSize || total > maxBuffered {
+		pw.send()
+	}
+	return pw.failed()
+}
+
+// send the lines gathered so far off to be compressed
+func (pw *parallelWriter) send() {
+	job := &compressJob{in: pw.buf, done: make(chan struct{})}
+	pw.buf = nil
+	pw.wrote = true
+	pw.pool.slots <- struct{}{}
+	pw.wg.Add(1)
+	pw.queue <- job
+	pw.pool.jobs <- job
+}
+
+// send what there is, and wait for everything to be written out
+func (pw *parallelWriter) flush() error {
+	if len(pw.buf) > 0 {
+		pw.send()
+	}
+	pw.wg.Wait()
+	return pw.failed()
+}
+
+func (pw *parallelWriter) close() (err error) {
+	if len(pw.buf) > 0 || !pw.wrote {
+		pw.send() // even if empty, as a gzip.Writer would write a member
+	}
+	err = pw.flush()
+	close(pw.queue)
+	pw.pool.leave()
+	return
+}
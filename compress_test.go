@@ -0,0 +1,106 @@
+package giashard
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParallelCompression(t *testing.T) {
+	if err := SetCompression(6, 4); err != nil {
+		t.Fatalf("SetCompression: error: %v", err)
+	}
+	defer SetCompression(9, 0)
+	if err := SetCompression(10, 4); err == nil {
+		t.Errorf("SetCompression: expected an error for level 10")
+	}
+	if err := SetCompression(6, 4); err != nil {
+		t.Fatalf("SetCompression: error: %v", err)
+	}
+
+	// enough text for several blocks, and a row index to check offsets
+	dir := t.TempDir()
+	text := strings.Repeat("lorem ipsum ", 1000)
+	b, err := NewBatch(dir, 1<<30, "id", "text")
+	if err != nil {
+		t.Fatalf("NewBatch: error: %v", err)
+	}
+	if err = b.IndexRows(100); err != nil {
+		t.Fatalf("IndexRows: error: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		row := map[string][]byte{"id": []byte(fmt.Sprint(i)), "text": []byte(text)}
+		if err = b.WriteRow(row); err != nil {
+			t.Fatalf("WriteRow: error: %v", err)
+		}
+	}
+	if err = b.Close(); err != nil {
+		t.Fatalf("Close: error: %v", err)
+	}
+
+	batch := filepath.Join(dir, "1")
+	if err = VerifyBatch(batch); err != nil {
+		t.Errorf("VerifyBatch: error: %v", err)
+	}
+	m, err := ReadBatchMeta(batch)
+	if err != nil || m.Rows != 500 {
+		t.Fatalf("expected 500 rows in the metadata, got %+v, %v", m, err)
+	}
+	rows, err := ReadRows(batch, 250, 2, "id", "text")
+	if err != nil {
+		t.Fatalf("ReadRows: error: %v", err)
+	}
+	if len(rows) != 2 || string(rows[0]["id"]) != "250" || string(rows[1]["text"]) != text {
+		t.Errorf("unexpected rows from 250: %d", len(rows))
+	}
+
+	// a writer with nothing written still leaves a gzip file
+	w, err := NewLineWriter(filepath.Join(dir, "empty.gz"))
+	if err != nil {
+		t.Fatalf("NewLineWriter: error: %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Close: error: %v", err)
+	}
+	if cm, err := NewColumnMeta(filepath.Join(dir, "empty.gz")); err != nil || cm.Rows != 0 || cm.Compressed == 0 {
+		t.Errorf("expected an empty gzip file, got %+v, %v", cm, err)
+	}
+
+	// a pool that is replaced is closed once its last writer is
+	if w, err = NewLineWriter(filepath.Join(dir, "replaced.gz")); err != nil {
+		t.Fatalf("NewLineWriter: error: %v", err)
+	}
+	pool := w.par.pool
+	if err = SetCompression(6, 2); err != nil {
+		t.Fatalf("SetCompression: error: %v", err)
+	}
+	if err = w.WriteLine([]byte("line")); err != nil {
+		t.Errorf("WriteLine: error: %v", err)
+	}
+	select {
+	case <-pool.jobs:
+		t.Errorf("expected the replaced pool to be open while its writer is")
+	default:
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Close: error: %v", err)
+	}
+	if _, open := <-pool.jobs; open {
+		t.Errorf("expected the replaced pool to be closed with its writer")
+	}
+
+	// an error writing out a block is returned from a later write
+	_, pool = joinCompression(false)
+	pw := newParallelWriter(pool, func(p []byte) (int, error) {
+		return 0, fmt.Errorf("disk full")
+	})
+	pw.write(make([]byte, blockSize))
+	pw.wg.Wait()
+	if err = pw.write([]byte("more\n")); err == nil {
+		t.Errorf("expected an error from write after a block failed")
+	}
+	if err = pw.close(); err == nil {
+		t.Errorf("expected an error from close after a block failed")
+	}
+}
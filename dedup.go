@@ -0,0 +1,71 @@
+package giashard
+
+/*
+Exact deduplication keeps only the first row with a given text, either
+within each shard or across the whole tree. Rows are compared by a hash of
+their base64 decoded text, which can also be written out as a column.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+type Deduper struct {
+	col     string // text column
+	global  bool   // rather than per shard
+	hashcol string // column to write the hash to, if any
+	set     *HashSet
+}
+
+// hash of the base64 decoded text, or of the text as it is if it isn't
+// valid base64
+func TextHash(text []byte) (h Hash) {
+	buf := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+	n, err := base64.StdEncoding.Decode(buf, text)
+	if err != nil {
+		buf, n = text, len(text)
+	}
+	sum := sha256.Sum256(buf[:n])
+	copy(h[:], sum[:])
+	return
+}
+
+// deduplicate on the text in col, within each shard or globally. up to
+// mem hashes are kept in memory, beyond that they are spilled to dir
+func NewDeduper(col string, global bool, mem int, dir string) *Deduper {
+	return &Deduper{col: col, global: global, set: NewHashSet(dir, mem)}
+}
+
+// write the hex encoded text hash of each row to the named column
+func (d *Deduper) HashColumn(name string) {
+	d.hashcol = name
+}
+
+// has the text of this row been seen before in the shard (or at all)
+func (d *Deduper) Seen(shard uint64, row map[string][]byte) (seen bool, err error) {
+	h := TextHash(row[d.col])
+	if d.hashcol != "" {
+		row[d.hashcol] = []byte(hex.EncodeToString(h[:]))
+	}
+
+	if !d.global {
+		// make the same text in different shards hash differently
+		x := binary.LittleEndian.Uint64(h[:8]) ^ mix64(shard+1)
+		binary.LittleEndian.PutUint64(h[:8], x)
+	}
+	return d.set.Add(h)
+}
+
+func (d *Deduper) Close() error {
+	return d.set.Close()
+}
+
+// drop rows whose text has already been written. the number dropped in
+// each shard is counted in the summary
+func (s *Shard) Dedup(d *Deduper) {
+	s.dedup = d
+	s.summary.Duplicates = make(map[uint64]int64)
+}
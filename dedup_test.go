@@ -0,0 +1,106 @@
+package giashard
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+)
+
+func TestHashSet(t *testing.T) {
+	hs := NewHashSet(t.TempDir(), 100)
+	defer hs.Close()
+
+	for pass := 0; pass < 2; pass++ {
+		for i := 0; i < 1000; i++ {
+			seen, err := hs.Add(TextHash([]byte(fmt.Sprint(i))))
+			if err != nil {
+				t.Fatalf("HashSet.Add: error: %v", err)
+			}
+			if seen != (pass == 1) {
+				t.Errorf("HashSet.Add(%d) pass %d: got seen %v", i, pass, seen)
+			}
+		}
+	}
+	if hs.Len() != 1000 {
+		t.Errorf("HashSet.Len: got %d expected 1000", hs.Len())
+	}
+	// ten runs spilled, merged to one of eight and one of two
+	if len(hs.runs) != 2 || hs.runs[0].n != 800 || hs.runs[1].n != 200 {
+		t.Errorf("HashSet: expected runs of 800 and 200 hashes, got %d runs", len(hs.runs))
+	}
+
+	// past maxRuns, all the runs are merged into one
+	few := NewHashSet(t.TempDir(), 100)
+	defer few.Close()
+	few.maxRuns = 2
+	for pass := 0; pass < 2; pass++ {
+		for i := 0; i < 800; i++ {
+			seen, err := few.Add(TextHash([]byte(fmt.Sprint(i))))
+			if err != nil || seen != (pass == 1) {
+				t.Fatalf("HashSet.Add(%d) pass %d: got seen %v, %v", i, pass, seen, err)
+			}
+		}
+		if len(few.runs) != 1 || few.runs[0].n != 800 {
+			t.Errorf("HashSet: expected one run of 800 hashes, got %d runs", len(few.runs))
+		}
+	}
+}
+
+func TestDeduper(t *testing.T) {
+	text := []byte(base64.StdEncoding.EncodeToString([]byte("same text")))
+	row := func() map[string][]byte {
+		return map[string][]byte{"plain_text": text}
+	}
+
+	d := NewDeduper("plain_text", false, 10, t.TempDir())
+	defer d.Close()
+	d.HashColumn("hash")
+	for _, tcase := range []struct {
+		shard uint64
+		seen  bool
+	}{{1, false}, {1, true}, {2, false}} {
+		r := row()
+		seen, err := d.Seen(tcase.shard, r)
+		if err != nil || seen != tcase.seen {
+			t.Errorf("Deduper.Seen(%d): got %v (%v) expected %v", tcase.shard, seen, err, tcase.seen)
+		}
+		if len(r["hash"]) != 32 {
+			t.Errorf("Deduper: hash column %q", r["hash"])
+		}
+	}
+
+	g := NewDeduper("plain_text", true, 10, t.TempDir())
+	defer g.Close()
+	g.Seen(1, row())
+	if seen, _ := g.Seen(2, row()); !seen {
+		t.Errorf("Deduper: global deduplication missed a duplicate in another shard")
+	}
+}
+
+func TestLSH(t *testing.T) {
+	mh := NewMinHasher(64, 3, 1)
+	lsh, err := NewLSH(64, 0.7)
+	if err != nil {
+		t.Fatalf("NewLSH: error: %v", err)
+	}
+	if _, err = NewLSH(0, 0.7); err == nil {
+		t.Errorf("NewLSH: expected an error for 0 hashes")
+	}
+
+	words := make([]byte, 0, 2000)
+	for i := 0; i < 200; i++ {
+		words = append(words, fmt.Sprintf("w%d ", i)...)
+	}
+	variant := append([]byte("changed "), words[9:]...)
+	other := []byte("an entirely different document with nothing in common")
+
+	a := lsh.Add(mh.Signature(words))
+	b := lsh.Add(mh.Signature(variant))
+	c := lsh.Add(mh.Signature(other))
+	if lsh.Cluster(b) != a {
+		t.Errorf("LSH: near-duplicate not clustered (similarity %v)", mh.Signature(words).Similarity(mh.Signature(variant)))
+	}
+	if lsh.Cluster(c) != c {
+		t.Errorf("LSH: unrelated document clustered with %d", lsh.Cluster(c))
+	}
+}
@@ -0,0 +1,287 @@
+package giashard
+
+/*
+Columns of short, repetitive lines, such as url, mime and source, compress
+poorly with gzip, as a batch rarely holds enough of them for the
+compressor to learn from. A zstd dictionary trained on a sample of the
+input gives the compressor that to start from.
+
+Dictionaries belong to a tree, and are kept in its dicts directory as
+col.zdict, one for each column. A column is written as col.zst with its
+dictionary if the tree has one for it, and as col.gz otherwise, unless
+the batch already has the column in the other form, which is appended
+to. Readers and writers find the dictionary of a column file by looking
+for dicts/col.zdict in its directory and the directories above it, so
+that a batch can be read wherever it is in the tree. The search stops at
+the root of the tree, the first directory with a manifest or a dicts
+directory, and never goes higher than a tree root can be above a batch,
+two directories, so that dictionaries outside the tree are never used,
+even for trees without a manifest. Each
+zstd frame records the ID of its dictionary, so a reader given the wrong
+one fails rather than reading garbage.
+
+A dictionary is never replaced once there are columns written with it.
+*/
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+const DictDir = "dicts"
+
+const (
+	maxDictSize = 64 << 10
+	sampleLines = 16 // lines in each sample a dictionary is trained on
+	maxDictUp   = 2  // directories from a batch up to the root of its tree
+)
+
+// dictionaries read so far, by path
+var dictCache = struct {
+	sync.Mutex
+	dicts map[string][]byte
+}{dicts: make(map[string][]byte)}
+
+// train a zstd dictionary on sample lines of a column, for compressing it
+// at the given gzip level. the lines are taken a few at a time, as they
+// would be in the column, as a line of a column such as mime is too short
+// to learn anything from on its own
+func TrainDict(lines [][]byte, level int) (d []byte, err error) {
+	var samples [][]byte
+	seen := make(map[string]bool)
+	for i := 0; i < len(lines); i += sampleLines {
+		var sample []byte
+		for j := i; j < i+sampleLines && j < len(lines); j++ {
+			sample = append(append(sample, lines[j]...), '\n')
+		}
+		if !seen[string(sample)] {
+			seen[string(sample)] = true
+			samples = append(samples, sample)
+		}
+	}
+	if len(samples) < 2 {
+		return nil, fmt.Errorf("too few different sample lines to train a dictionary on")
+	}
+	// the builder panics on some inputs with too little in common
+	defer func() {
+		if e := recover(); e != nil {
+			d, err = nil, fmt.Errorf("no dictionary could be trained on the sample: %v", e)
+		}
+	}()
+	return dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: maxDictSize,
+		HashBytes:   6,
+		ZstdLevel:   zstd.EncoderLevelFromZstd(level),
+	})
+}
+
+// whether the lines are all the same, such as the source column of a
+// single input. gzip does as well as anything on such a column, and there
+// is nothing to train a dictionary on
+func ConstantLines(lines [][]byte) bool {
+	for _, line := range lines {
+		if string(line) != string(lines[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// the path of the dictionary of col in the tree at dir
+func DictPath(dir string, col string) string {
+	return filepath.Join(dir, DictDir, col+".zdict")
+}
+
+// store the dictionary of col in the tree at dir. a dictionary already
+// there is not replaced, as columns may have been written with it
+func WriteDict(dir string, col string, d []byte) (err error) {
+	fname := DictPath(dir, col)
+	if _, err = os.Stat(fname); err == nil {
+		return fmt.Errorf("%v already has a dictionary for %v", dir, col)
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(fname), os.ModePerm); err != nil {
+		return
+	}
+	// written alongside and moved into place, so it is never seen partly
+	// written
+	tmp := fname + ".tmp"
+	if err = ioutil.WriteFile(tmp, d, 0666); err != nil {
+		return
+	}
+	return os.Rename(tmp, fname)
+}
+
+// read the dictionary at fname
+func ReadDict(fname string) (d []byte, err error) {
+	dictCache.Lock()
+	defer dictCache.Unlock()
+	if d, ok := dictCache.dicts[fname]; ok {
+		return d, nil
+	}
+	if d, err = ioutil.ReadFile(fname); err != nil {
+		return
+	}
+	dictCache.dicts[fname] = d
+	return
+}
+
+// the dictionary of col for a batch at dir, found in a dicts directory
+// in dir or above it, up to the root of the tree, or "" if there is none
+func FindDict(dir string, col string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for up := 0; up <= maxDictUp; up++ {
+		fname := DictPath(dir, col)
+		if _, err := os.Stat(fname); err == nil {
+			return fname
+		}
+		if _, err := os.Stat(filepath.Dir(fname)); err == nil {
+			return "" // the tree's dictionaries, without one for col
+		}
+		if _, err := os.Stat(filepath.Join(dir, ManifestName)); err == nil {
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+	return ""
+}
+
+// the dictionary of col of the tree at root, or "" if it has none
+func TreeDict(root string, col string) string {
+	fname := DictPath(root, col)
+	if _, err := os.Stat(fname); err != nil {
+		return ""
+	}
+	return fname
+}
+
+// the file holding column col of the batch at dir, compressed with zstd
+// if there is such a file, or else with gzip
+func ColumnFile(dir string, col string) string {
+	fname := filepath.Join(dir, col+".zst")
+	if _, err := os.Stat(fname); err == nil {
+		return fname
+	}
+	return filepath.Join(dir, col+".gz")
+}
+
+// the file to write column col of the batch at dir to: the file already
+// there, if any, otherwise with zstd if the tree has a dictionary for
+// the column, or else with gzip
+func ColumnOutputFile(dir string, col string) string {
+	fname := ColumnFile(dir, col)
+	if _, err := os.Stat(fname); os.IsNotExist(err) && FindDict(dir, col) != "" {
+		fname = filepath.Join(dir, col+".zst")
+	}
+	return fname
+}
+
+// the column a file holds, and whether it is compressed with zstd
+func columnName(fname string) (col string, zst bool) {
+	base := filepath.Base(fname)
+	if strings.HasSuffix(base, ".zst") {
+		return strings.TrimSuffix(base, ".zst"), true
+	}
+	return strings.TrimSuffix(base, ".gz"), false
+}
+
+// the dictionary to compress or decompress the column file with, if it
+// is compressed with zstd and there is one
+func columnDict(fname string) (d []byte, err error) {
+	col, zst := columnName(fname)
+	if !zst {
+		return
+	}
+	if path := FindDict(filepath.Dir(fname), col); path != "" {
+		d, err = ReadDict(path)
+	}
+	return
+}
+
+// whether column file a can be appended to b as it is: both compressed
+// the same way, and with the same dictionary if any
+func SameCompression(a string, b string) (same bool, err error) {
+	_, az := columnName(a)
+	_, bz := columnName(b)
+	if az != bz {
+		return false, nil
+	}
+	da, err := columnDict(a)
+	if err != nil {
+		return
+	}
+	db, err := columnDict(b)
+	if err != nil {
+		return
+	}
+	return string(da) == string(db), nil
+}
+
+// decompress the column file fname, read from r, according to its name
+func newDecompressor(fname string, r io.Reader) (z io.ReadCloser, err error) {
+	if _, zst := columnName(fname); !zst {
+		return gzip.NewReader(r)
+	}
+	d, err := columnDict(fname)
+	if err != nil {
+		return
+	}
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+	if d != nil {
+		opts = append(opts, zstd.WithDecoderDicts(d))
+	}
+	zd, err := zstd.NewReader(r, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", fname, err)
+	}
+	return zd.IOReadCloser(), nil
+}
+
+// a compressor for the column file fname, writing to w, at the given
+// gzip level
+func newCompressor(fname string, w io.Writer, level int) (z compressor, err error) {
+	if _, zst := columnName(fname); !zst {
+		gz, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		gz.Comment = "Written by giashard"
+		return gz, nil
+	}
+	d, err := columnDict(fname)
+	if err != nil {
+		return
+	}
+	// thousands of batches may be open at once, so keep each small
+	opts := []zstd.EOption{
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithLowerEncoderMem(true),
+		zstd.WithWindowSize(1 << 20),
+	}
+	if d != nil {
+		opts = append(opts, zstd.WithEncoderDict(d))
+	}
+	zw, err := zstd.NewWriter(w, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return zw, nil
+}
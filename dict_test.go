@@ -0,0 +1,130 @@
+package giashard
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDict(t *testing.T) {
+	tree := t.TempDir()
+	var lines [][]byte
+	for i := 0; i < 5000; i++ {
+		lines = append(lines, []byte(fmt.Sprintf("https://www.example.com/news/%d/article.html", i*7919%10000)))
+	}
+	d, err := TrainDict(lines, 9)
+	if err != nil {
+		t.Fatalf("TrainDict: error: %v", err)
+	}
+	// a column with one value, such as the source of a single input, has
+	// nothing to train on
+	source := make([][]byte, 100)
+	for i := range source {
+		source[i] = []byte("host:input.gz")
+	}
+	if !ConstantLines(source) || ConstantLines(lines[:2]) {
+		t.Errorf("ConstantLines: expected only the source lines to be constant")
+	}
+	if _, err := TrainDict(source, 9); err == nil {
+		t.Errorf("TrainDict: expected an error for a constant column")
+	}
+
+	if err = WriteDict(tree, "url", d); err != nil {
+		t.Fatalf("WriteDict: error: %v", err)
+	}
+	if err = WriteDict(tree, "url", d); err == nil {
+		t.Errorf("WriteDict: expected an error replacing a dictionary")
+	}
+
+	// only the column with a dictionary is written with zstd, with a row
+	// index to check that frames can be started from
+	if err = os.MkdirAll(filepath.Join(tree, "0"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBatch(filepath.Join(tree, "0"), 1<<30, "url", "text")
+	if err != nil {
+		t.Fatalf("NewBatch: error: %v", err)
+	}
+	if err = b.IndexRows(100); err != nil {
+		t.Fatalf("IndexRows: error: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		row := map[string][]byte{"url": lines[i], "text": []byte(fmt.Sprintf("text %d", i))}
+		if err = b.WriteRow(row); err != nil {
+			t.Fatalf("WriteRow: error: %v", err)
+		}
+	}
+	if err = b.Close(); err != nil {
+		t.Fatalf("Close: error: %v", err)
+	}
+
+	batch := filepath.Join(tree, "0", "1")
+	if fname := ColumnFile(batch, "url"); filepath.Base(fname) != "url.zst" {
+		t.Errorf("expected url to be compressed with zstd, got %v", fname)
+	}
+	if fname := ColumnFile(batch, "text"); filepath.Base(fname) != "text.gz" {
+		t.Errorf("expected text to be compressed with gzip, got %v", fname)
+	}
+	if cols, err := BatchColumns(batch); err != nil || fmt.Sprint(cols) != "[text url]" {
+		t.Errorf("expected columns [text url], got %v, %v", cols, err)
+	}
+	if err = VerifyBatch(batch); err != nil {
+		t.Errorf("VerifyBatch: error: %v", err)
+	}
+	rows, err := ReadRows(batch, 250, 2, "url", "text")
+	if err != nil {
+		t.Fatalf("ReadRows: error: %v", err)
+	}
+	if len(rows) != 2 || string(rows[0]["url"]) != string(lines[250]) || string(rows[1]["text"]) != "text 251" {
+		t.Errorf("unexpected rows from 250: %q", rows)
+	}
+
+	same, err := SameCompression(ColumnFile(batch, "url"), filepath.Join(t.TempDir(), "url.zst"))
+	if err != nil || same {
+		t.Errorf("expected a column without the dictionary to be compressed differently, got %v, %v", same, err)
+	}
+
+	// a dictionary above the root of a tree is not the tree's
+	s, err := NewShard(filepath.Join(tree, "tree"), 0, 1<<30, "url", "url")
+	if err != nil {
+		t.Fatalf("NewShard: error: %v", err)
+	}
+	if err = s.WriteRow(map[string][]byte{"url": lines[0]}); err != nil {
+		t.Fatalf("WriteRow: error: %v", err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close: error: %v", err)
+	}
+	if fname := ColumnFile(filepath.Join(tree, "tree", "0", "1"), "url"); filepath.Base(fname) != "url.gz" {
+		t.Errorf("expected url to be compressed with gzip outside the tree with the dictionary, got %v", fname)
+	}
+
+	// nor is one more than a tree above a batch, for trees without a
+	// manifest
+	far := filepath.Join(tree, "merged", "out", "0", "1")
+	if err = os.MkdirAll(far, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if fname := FindDict(far, "url"); fname != "" {
+		t.Errorf("expected no dictionary three directories above a batch, got %v", fname)
+	}
+	if fname := FindDict(filepath.Join(tree, "merged", "0"), "url"); fname != DictPath(tree, "url") {
+		t.Errorf("expected the dictionary two directories above a batch, got %v", fname)
+	}
+
+	// without its dictionary, the column can't be read
+	if err = os.Rename(filepath.Join(tree, DictDir), filepath.Join(tree, "elsewhere")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewLineReader(ColumnFile(batch, "url"))
+	if err != nil {
+		t.Fatalf("NewLineReader: error: %v", err)
+	}
+	defer r.Close()
+	for r.Next() {
+	}
+	if r.Err() == nil {
+		t.Errorf("expected an error reading a column without its dictionary")
+	}
+}
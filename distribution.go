@@ -0,0 +1,192 @@
+package giashard
+
+/*
+A distribution records where rows would have gone, without writing them,
+so that the balance of shards and batches can be checked before a long
+sharding run. Batches are projected the same way that Batch rotates them,
+assuming an empty output tree. With buckets, batches rotate within each
+bucket of a shard, so they are projected for each bucket and added up.
+*/
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+type Distribution struct {
+	n       uint
+	k       uint  // buckets per shard
+	size    int64 // batch size
+	rows    []int64
+	bytes   []int64
+	batches []int   // projected number of batches, by shard and bucket
+	current []int64 // size of the projected current batch, by shard and bucket
+	slugs   []map[string]*SlugCount
+	failed  int64
+}
+
+type SlugCount struct {
+	Slug  string `json:"slug"`
+	Rows  int64  `json:"rows"`
+	Bytes int64  `json:"bytes"`
+}
+
+type ShardDistribution struct {
+	Shard    uint64      `json:"shard"`
+	Rows     int64       `json:"rows"`
+	Bytes    int64       `json:"bytes"`
+	Batches  int         `json:"batches"`
+	Slugs    int         `json:"slugs"`
+	TopSlugs []SlugCount `json:"top_slugs"`
+}
+
+type DistributionReport struct {
+	Shards    []ShardDistribution `json:"shards"`
+	Rows      int64               `json:"rows"`
+	Bytes     int64               `json:"bytes"`
+	Batches   int                 `json:"batches"`
+	Failed    int64               `json:"failed"`  // rows without a slug
+	MaxMean   float64             `json:"maxmean"` // largest shard over mean shard, by bytes
+	Gini      float64             `json:"gini"`    // gini coefficient of shard bytes
+	BatchSize int64               `json:"batchsize"`
+}
+
+// the distribution over 1<<n shards of k buckets each, k being 0 or 1 for
+// none, of batches of the given size
+func NewDistribution(n uint, k uint, size int64) *Distribution {
+	d := &Distribution{
+		n:     n,
+		size:  size,
+		rows:  make([]int64, 1<<n),
+		bytes: make([]int64, 1<<n),
+		slugs: make([]map[string]*SlugCount, 1<<n),
+	}
+	d.setBuckets(k)
+	return d
+}
+
+func (d *Distribution) setBuckets(k uint) {
+	if k < 1 {
+		k = 1
+	}
+	d.k = k
+	d.batches = make([]int, (1<<d.n)*int(k))
+	d.current = make([]int64, (1<<d.n)*int(k))
+}
+
+// count the row as going to the given bucket of the shard
+func (d *Distribution) Add(shard uint64, bucket uint, slug string, row map[string][]byte) {
+	rowsize := RowSize(row)
+	d.rows[shard]++
+	d.bytes[shard] += rowsize
+
+	// same slot and rule as Shard.WriteRow and Batch.WriteRow
+	slot := shard*uint64(d.k) + uint64(bucket)
+	if d.batches[slot] == 0 {
+		d.batches[slot] = 1
+	} else if rowsize+d.current[slot] > d.size {
+		d.batches[slot]++
+		d.current[slot] = 0
+	}
+	d.current[slot] += rowsize
+
+	if d.slugs[shard] == nil {
+		d.slugs[shard] = make(map[string]*SlugCount)
+	}
+	sc, ok := d.slugs[shard][slug]
+	if !ok {
+		sc = &SlugCount{Slug: slug}
+		d.slugs[shard][slug] = sc
+	}
+	sc.Rows++
+	sc.Bytes += rowsize
+}
+
+// count a row for which no slug could be found
+func (d *Distribution) Fail() {
+	d.failed++
+}
+
+// summarise the distribution, with the k largest slugs by bytes in each
+// shard
+func (d *Distribution) Report(k int) (r *DistributionReport) {
+	r = &DistributionReport{Failed: d.failed, BatchSize: d.size}
+	for i := range d.rows {
+		sd := ShardDistribution{
+			Shard: uint64(i),
+			Rows:  d.rows[i],
+			Bytes: d.bytes[i],
+			Slugs: len(d.slugs[i]),
+		}
+		for _, n := range d.batches[i*int(d.k) : (i+1)*int(d.k)] {
+			sd.Batches += n
+		}
+		for _, sc := range d.slugs[i] {
+			sd.TopSlugs = append(sd.TopSlugs, *sc)
+		}
+		sort.Slice(sd.TopSlugs, func(a, b int) bool {
+			sa, sb := sd.TopSlugs[a], sd.TopSlugs[b]
+			return sa.Bytes > sb.Bytes || (sa.Bytes == sb.Bytes && sa.Slug < sb.Slug)
+		})
+		if len(sd.TopSlugs) > k {
+			sd.TopSlugs = sd.TopSlugs[:k]
+		}
+
+		r.Shards = append(r.Shards, sd)
+		r.Rows += sd.Rows
+		r.Bytes += sd.Bytes
+		r.Batches += sd.Batches
+	}
+
+	r.MaxMean, r.Gini = skew(d.bytes)
+	return
+}
+
+// max/mean and gini coefficient of the sizes
+func skew(sizes []int64) (maxmean float64, gini float64) {
+	sorted := make([]int64, len(sizes))
+	copy(sorted, sizes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var total, weighted float64
+	for i, x := range sorted {
+		total += float64(x)
+		weighted += float64(i+1) * float64(x)
+	}
+	if total == 0 {
+		return
+	}
+
+	n := float64(len(sorted))
+	maxmean = float64(sorted[len(sorted)-1]) / (total / n)
+	gini = 2*weighted/(n*total) - (n+1)/n
+	return
+}
+
+// write out the report as a table, one line per shard, and a summary
+func (r *DistributionReport) Print(w io.Writer) (err error) {
+	_, err = fmt.Fprintf(w, "shard\trows\tbytes\tbatches\tslugs\ttop slugs\n")
+	if err != nil {
+		return
+	}
+	for _, sd := range r.Shards {
+		top := ""
+		for i, sc := range sd.TopSlugs {
+			if i > 0 {
+				top += " "
+			}
+			top += fmt.Sprintf("%s:%d", sc.Slug, sc.Bytes)
+		}
+		_, err = fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%s\n", sd.Shard, sd.Rows, sd.Bytes, sd.Batches, sd.Slugs, top)
+		if err != nil {
+			return
+		}
+	}
+	_, err = fmt.Fprintf(w, "total\t%d\t%d\t%d\n", r.Rows, r.Bytes, r.Batches)
+	if err != nil {
+		return
+	}
+	_, err = fmt.Fprintf(w, "failed rows: %d\nbatch size: %d\nmax/mean: %.3f\ngini: %.3f\n", r.Failed, r.BatchSize, r.MaxMean, r.Gini)
+	return
+}
@@ -0,0 +1,257 @@
+package giashard
+
+/*
+A filter is a list of predicates over the columns of a row, all of which
+must hold for the row to be kept. Each predicate is written as
+
+    field op value
+
+where field is one of
+
+    col            the column as it is
+    len(col)       length of the column in bytes
+    textlen(col)   length of the base64 decoded column in bytes
+    col.part       part of the column parsed as a url: scheme, host, port,
+                   path, query, fragment, tld or sld
+
+and op is one of
+
+    == !=          string equality
+    =~ !~          regular expression match
+    < <= > >=      numeric comparison
+    in notin       membership of a comma separated set
+
+For example
+
+    mime == text/html
+    textlen(plain_text) >= 200
+    url !~ /(login|cart)/
+    url.tld in de,at,ch
+
+A value may be given in double quotes, as a Go string literal.
+*/
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/weppos/publicsuffix-go/publicsuffix"
+)
+
+type Filter struct {
+	preds []*Predicate
+}
+
+type Predicate struct {
+	Expr     string
+	Rejected int64 // rows this predicate was the first to reject
+
+	col   string
+	fn    string // "", "len", "textlen"
+	part  string // url part
+	op    string
+	value string
+	set   map[string]bool
+	re    *regexp.Regexp
+	num   int64
+}
+
+var pred_re = regexp.MustCompile(`^\s*(?:(len|textlen)\(\s*([^()\s]+)\s*\)|([^\s.=!<>~]+)(?:\.([a-z]+))?)\s*(==|!=|=~|!~|<=|>=|<|>|\bnotin\b|\bin\b)\s*(.*?)\s*$`)
+
+var url_parts = map[string]bool{
+	"scheme": true, "host": true, "port": true, "path": true,
+	"query": true, "fragment": true, "tld": true, "sld": true,
+}
+
+func ParsePredicate(expr string) (p *Predicate, err error) {
+	ms := pred_re.FindStringSubmatch(expr)
+	if ms == nil {
+		return nil, fmt.Errorf("cannot parse filter %q", expr)
+	}
+
+	p = &Predicate{Expr: strings.TrimSpace(expr), fn: ms[1], col: ms[2], op: ms[5], value: ms[6]}
+	if p.fn == "" {
+		p.col, p.part = ms[3], ms[4]
+	}
+	if p.part != "" && !url_parts[p.part] {
+		return nil, fmt.Errorf("filter %q: unknown url part %v", expr, p.part)
+	}
+	if strings.HasPrefix(p.value, `"`) {
+		if p.value, err = strconv.Unquote(p.value); err != nil {
+			return nil, fmt.Errorf("filter %q: %w", expr, err)
+		}
+	}
+
+	switch p.op {
+	case "=~", "!~":
+		if p.re, err = regexp.Compile(p.value); err != nil {
+			return nil, fmt.Errorf("filter %q: %w", expr, err)
+		}
+	case "<", "<=", ">", ">=":
+		if p.num, err = strconv.ParseInt(p.value, 10, 64); err != nil {
+			return nil, fmt.Errorf("filter %q: %w", expr, err)
+		}
+	case "in", "notin":
+		p.set = make(map[string]bool)
+		for _, v := range strings.Split(p.value, ",") {
+			p.set[strings.TrimSpace(v)] = true
+		}
+	}
+	return
+}
+
+func NewFilter(exprs ...string) (f *Filter, err error) {
+	f = &Filter{}
+	for _, expr := range exprs {
+		p, err := ParsePredicate(expr)
+		if err != nil {
+			return nil, err
+		}
+		f.preds = append(f.preds, p)
+	}
+	return
+}
+
+func (f *Filter) Predicates() []*Predicate {
+	return f.preds
+}
+
+// does the row pass every predicate. the first one that fails has its
+// count of rejected rows incremented
+func (f *Filter) Keep(row map[string][]byte) bool {
+	if p := f.reject(row); p != nil {
+		p.Rejected++
+		return false
+	}
+	return true
+}
+
+// the first predicate the row fails, if any
+func (f *Filter) reject(row map[string][]byte) *Predicate {
+	urls := make(map[string]*url.URL)
+	for _, p := range f.preds {
+		if !p.eval(row, urls) {
+			return p
+		}
+	}
+	return nil
+}
+
+func (p *Predicate) eval(row map[string][]byte, urls map[string]*url.URL) bool {
+	var v string
+	var n int64
+
+	col := row[p.col]
+	switch {
+	case p.fn == "len":
+		n = int64(len(col))
+		v = strconv.FormatInt(n, 10)
+	case p.fn == "textlen":
+		n = int64(base64.StdEncoding.DecodedLen(len(col)))
+		if len(col) > 1 {
+			// DecodedLen doesn't know about padding
+			n -= int64(strings.Count(string(col[len(col)-2:]), "="))
+		}
+		v = strconv.FormatInt(n, 10)
+	case p.part != "":
+		v = urlPart(col, p.col, p.part, urls)
+	default:
+		v = string(col)
+	}
+
+	switch p.op {
+	case "==":
+		return v == p.value
+	case "!=":
+		return v != p.value
+	case "=~":
+		return p.re.MatchString(v)
+	case "!~":
+		return !p.re.MatchString(v)
+	case "in":
+		return p.set[v]
+	case "notin":
+		return !p.set[v]
+	}
+
+	// numeric comparisons
+	if p.fn == "" {
+		var err error
+		if n, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return false
+		}
+	}
+	switch p.op {
+	case "<":
+		return n < p.num
+	case "<=":
+		return n <= p.num
+	case ">":
+		return n > p.num
+	case ">=":
+		return n >= p.num
+	}
+	return false
+}
+
+// the given part of the column parsed as a url. the parsed url is kept
+// in urls so that each column is only parsed once per row
+func urlPart(col []byte, name string, part string, urls map[string]*url.URL) string {
+	u, ok := urls[name]
+	if !ok {
+		u, _ = url.Parse(string(col))
+		urls[name] = u
+	}
+
+	host := ""
+	if u != nil {
+		host = strings.ToLower(strings.TrimRight(u.Hostname(), "."))
+	}
+	if host == "" {
+		// as for Slug, fall back to something more forgiving
+		if h, err := Host(string(col)); err == nil {
+			host = strings.ToLower(h)
+		}
+	}
+
+	switch part {
+	case "host":
+		return host
+	case "tld", "sld":
+		dn, err := publicsuffix.Parse(host)
+		if err != nil {
+			return ""
+		}
+		if part == "tld" {
+			return dn.TLD
+		}
+		return dn.SLD
+	}
+
+	if u == nil {
+		return ""
+	}
+	switch part {
+	case "scheme":
+		return u.Scheme
+	case "port":
+		return u.Port()
+	case "path":
+		return u.Path
+	case "query":
+		return u.RawQuery
+	case "fragment":
+		return u.Fragment
+	}
+	return ""
+}
+
+// only keep rows that pass the filter. rejected rows are counted in the
+// summary under the predicate that rejected them
+func (s *Shard) Filter(f *Filter) {
+	s.filter = f
+}
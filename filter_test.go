@@ -0,0 +1,60 @@
+package giashard
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	row := map[string][]byte{
+		"url":        []byte("https://www.example.de:8080/shop/cart?utm_source=x#top"),
+		"mime":       []byte("text/html"),
+		"plain_text": []byte(base64.StdEncoding.EncodeToString([]byte("hello world"))),
+	}
+
+	var filtercases = [...]struct {
+		expr string
+		keep bool
+	}{
+		{"mime == text/html", true},
+		{"mime != text/html", false},
+		{`mime == "text/plain"`, false},
+		{"textlen(plain_text) == 11", true},
+		{"textlen(plain_text) > 11", false},
+		{"len(plain_text) >= 16", true},
+		{"url !~ /(login|cart)", false},
+		{"url =~ ^https://", true},
+		{"url.tld in de,at,ch", true},
+		{"url.tld notin de,at,ch", false},
+		{"url.sld == example", true},
+		{"url.host == www.example.de", true},
+		{"url.port < 1024", false},
+		{"url.path == /shop/cart", true},
+		{"url.query =~ utm_", true},
+		{"url.fragment == top", true},
+		{"url.scheme == https", true},
+	}
+	for _, tcase := range filtercases {
+		f, err := NewFilter(tcase.expr)
+		if err != nil {
+			t.Errorf("NewFilter(%v): error: %v", tcase.expr, err)
+			continue
+		}
+		if keep := f.Keep(row); keep != tcase.keep {
+			t.Errorf("Filter(%v): got %v expected %v", tcase.expr, keep, tcase.keep)
+		}
+	}
+
+	for _, expr := range []string{"mime", "url.bogus == x", "len(url) > x", "url =~ ("} {
+		if _, err := NewFilter(expr); err == nil {
+			t.Errorf("NewFilter(%v): no error", expr)
+		}
+	}
+
+	f, _ := NewFilter("mime == text/html", "textlen(plain_text) > 100")
+	f.Keep(row)
+	f.Keep(row)
+	if p := f.Predicates(); p[0].Rejected != 0 || p[1].Rejected != 2 {
+		t.Errorf("Filter: rejected counts %d, %d expected 0, 2", p[0].Rejected, p[1].Rejected)
+	}
+}
@@ -5,10 +5,8 @@ go 1.18
 require (
 	github.com/klauspost/compress v1.17.9
 	github.com/weppos/publicsuffix-go v0.15.0
+	golang.org/x/text v0.14.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
-require (
-	golang.org/x/net v0.23.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
-)
+require golang.org/x/net v0.23.0 // indirect
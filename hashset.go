@@ -0,0 +1,259 @@
+package giashard
+
+/*
+A HashSet remembers 128-bit hashes in memory up to a limit. Beyond that,
+the hashes in memory are sorted and spilled to a run file on disk, with a
+bloom filter kept in memory so that most lookups never touch the disk.
+Memory use is then bounded by the limit plus about ten bits per spilled
+hash.
+
+Each run holds a file open and is probed on every lookup, so runs are
+merged as they pile up: a new run is merged with those before it while
+they are no bigger than what is being merged, leaving runs of halving
+size, at most one for each doubling of the hashes spilled, and all of
+them are merged into one once there are more than maxHashRuns.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+)
+
+const hashLen = 16
+
+const maxHashRuns = 16
+
+type Hash [hashLen]byte
+
+type HashSet struct {
+	dir     string // where to spill runs
+	max     int    // number of hashes to keep in memory
+	mem     map[Hash]struct{}
+	runs    []*hashRun
+	maxRuns int // runs to keep before merging them all
+}
+
+// a sorted run of hashes on disk
+type hashRun struct {
+	f     *os.File
+	n     int64
+	bloom *bloom
+}
+
+func NewHashSet(dir string, max int) *HashSet {
+	if max < 1 {
+		max = 1
+	}
+	return &HashSet{dir: dir, max: max, mem: make(map[Hash]struct{}), maxRuns: maxHashRuns}
+}
+
+// add the hash to the set, reporting whether it was already there
+func (hs *HashSet) Add(h Hash) (seen bool, err error) {
+	if _, ok := hs.mem[h]; ok {
+		return true, nil
+	}
+	for _, r := range hs.runs {
+		if seen, err = r.contains(h); seen || err != nil {
+			return
+		}
+	}
+
+	hs.mem[h] = struct{}{}
+	if len(hs.mem) >= hs.max {
+		err = hs.spill()
+	}
+	return
+}
+
+func (hs *HashSet) Len() (n int64) {
+	n = int64(len(hs.mem))
+	for _, r := range hs.runs {
+		n += r.n
+	}
+	return
+}
+
+func (hs *HashSet) spill() (err error) {
+	hashes := make([]Hash, 0, len(hs.mem))
+	for h := range hs.mem {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+
+	f, err := os.CreateTemp(hs.dir, "giashard-hashes-*")
+	if err != nil {
+		return
+	}
+	r := &hashRun{f, int64(len(hashes)), newBloom(len(hashes))}
+	buf := make([]byte, 0, len(hashes)*hashLen)
+	for _, h := range hashes {
+		buf = append(buf, h[:]...)
+		r.bloom.add(h)
+	}
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return
+	}
+
+	hs.runs = append(hs.runs, r)
+	hs.mem = make(map[Hash]struct{})
+
+	k, n := len(hs.runs)-1, r.n
+	for k > 0 && hs.runs[k-1].n <= n {
+		k--
+		n += hs.runs[k].n
+	}
+	if len(hs.runs) > hs.maxRuns {
+		k = 0
+	}
+	if len(hs.runs)-k > 1 {
+		return hs.merge(k)
+	}
+	return
+}
+
+// merge the runs from k on into one. the runs never hold the same hash,
+// as a hash is only added if it is in none of them
+func (hs *HashSet) merge(k int) (err error) {
+	f, err := os.CreateTemp(hs.dir, "giashard-hashes-*")
+	if err != nil {
+		return
+	}
+	var n int64
+	for _, r := range hs.runs[k:] {
+		n += r.n
+	}
+	merged := &hashRun{f, n, newBloom(int(n))}
+
+	readers := make([]*bufio.Reader, 0, len(hs.runs)-k)
+	heads := make([]Hash, 0, len(hs.runs)-k)
+	for _, r := range hs.runs[k:] {
+		rd := bufio.NewReader(io.NewSectionReader(r.f, 0, r.n*hashLen))
+		var h Hash
+		if _, err = io.ReadFull(rd, h[:]); err == nil {
+			readers = append(readers, rd)
+			heads = append(heads, h)
+		} else if err != io.EOF {
+			break
+		}
+		err = nil
+	}
+	w := bufio.NewWriter(f)
+	for err == nil && len(readers) > 0 {
+		min := 0
+		for i := range heads {
+			if bytes.Compare(heads[i][:], heads[min][:]) < 0 {
+				min = i
+			}
+		}
+		merged.bloom.add(heads[min])
+		if _, err = w.Write(heads[min][:]); err != nil {
+			break
+		}
+		if _, err = io.ReadFull(readers[min], heads[min][:]); err == io.EOF {
+			readers = append(readers[:min], readers[min+1:]...)
+			heads = append(heads[:min], heads[min+1:]...)
+			err = nil
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return
+	}
+
+	for _, r := range hs.runs[k:] {
+		r.f.Close()
+		os.Remove(r.f.Name())
+	}
+	hs.runs = append(hs.runs[:k], merged)
+	return
+}
+
+func (r *hashRun) contains(h Hash) (found bool, err error) {
+	if !r.bloom.has(h) {
+		return
+	}
+
+	var buf Hash
+	lo, hi := int64(0), r.n
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if _, err = r.f.ReadAt(buf[:], mid*hashLen); err != nil {
+			return
+		}
+		switch c := bytes.Compare(buf[:], h[:]); {
+		case c == 0:
+			return true, nil
+		case c < 0:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return
+}
+
+// remove the spilled runs
+func (hs *HashSet) Close() (err error) {
+	for _, r := range hs.runs {
+		if e := r.f.Close(); e != nil {
+			err = e
+		}
+		if e := os.Remove(r.f.Name()); e != nil {
+			err = e
+		}
+	}
+	hs.runs = nil
+	hs.mem = make(map[Hash]struct{})
+	return
+}
+
+// bloom filter with about 1% false positives. the hashes going in are
+// already uniformly distributed, so the probes are taken from them
+// directly
+type bloom struct {
+	bits []uint64
+	m    uint64
+}
+
+const bloomProbes = 7
+
+func newBloom(n int) *bloom {
+	m := uint64(n)*10 + 64
+	return &bloom{make([]uint64, (m+63)/64), m}
+}
+
+func (b *bloom) probes(h Hash, f func(bit uint64)) {
+	h1 := binary.LittleEndian.Uint64(h[:8])
+	h2 := binary.LittleEndian.Uint64(h[8:]) | 1
+	for i := uint64(0); i < bloomProbes; i++ {
+		f((h1 + i*h2) % b.m)
+	}
+}
+
+func (b *bloom) add(h Hash) {
+	b.probes(h, func(bit uint64) {
+		b.bits[bit/64] |= 1 << (bit % 64)
+	})
+}
+
+func (b *bloom) has(h Hash) bool {
+	found := true
+	b.probes(h, func(bit uint64) {
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
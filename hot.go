@@ -0,0 +1,54 @@
+package giashard
+
+/*
+Some domains are so large that their shard ends up many times the size of
+the others. Their documents can be spread over k consecutive shards
+starting at the one given by ShardId for the slug, choosing among them
+with a second hash of the whole key. Which slugs have been split, and over
+how many shards, is recorded in the manifest of the tree.
+*/
+
+import (
+	"hash/fnv"
+	"log"
+)
+
+func splitShard(base uint64, key string, k uint, n uint) uint64 {
+	hash := fnv.New64a() // a different hash than for the slug
+	hash.Write([]byte(key))
+	return (base + hash.Sum64()%uint64(k)) % (1 << n)
+}
+
+// spread the documents of the given slugs over k shards each
+func (s *Shard) SplitSlugs(k uint, slugs ...string) {
+	for _, slug := range slugs {
+		s.manifest.Split(slug, k)
+	}
+}
+
+// spread the documents of any slug over k shards once more than size
+// bytes of it have been written. this keeps a running total for every
+// slug seen, so memory grows with the number of distinct slugs
+func (s *Shard) SplitThreshold(size int64, k uint) {
+	s.hotsize = size
+	s.hotk = k
+	s.slugbytes = make(map[string]int64)
+}
+
+func (s *Shard) detectHot(slug string, row map[string][]byte) {
+	if s.slugbytes == nil {
+		return
+	}
+	if _, ok := s.manifest.Splits[slug]; ok {
+		return
+	}
+
+	n := s.slugbytes[slug] + RowSize(row)
+	if n > s.hotsize {
+		log.Printf("Slug %v exceeds %d bytes, splitting it over %d shards", slug, s.hotsize, s.hotk)
+		s.manifest.Split(slug, s.hotk)
+		delete(s.slugbytes, slug)
+		return
+	}
+	s.slugbytes[slug] = n
+}
@@ -1,8 +1,10 @@
 package giashard
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -23,6 +25,12 @@ type JsonlReader struct {
 	f     io.ReadCloser
 	z     io.ReadCloser
 	fatal bool
+	lr    *LineReader       // of the decompressed input
+	lim   recordLimit       // what to do with records that are too long
+	rec   JsonlRecord       // the current record
+	row   map[string][]byte // the current row, reused
+	enc   []byte            // buffer for the encoded text
+	err   error
 }
 
 func NewJsonlReader(filename string) (r *JsonlReader, err error) {
@@ -46,7 +54,13 @@ func NewJsonlReader(filename string) (r *JsonlReader, err error) {
 		}
 		z = d.IOReadCloser() // to match LineReader
 	}
-	r = &JsonlReader{f, z, true}
+	r = &JsonlReader{
+		f:     f,
+		z:     z,
+		fatal: true,
+		lr:    newLineReader(z, filename),
+		row:   make(map[string][]byte, 3),
+	}
 	return
 }
 
@@ -69,52 +83,101 @@ func (r *JsonlReader) Close() (err error) {
 	return
 }
 
-// send records read from file to channel (replaces Lines())
+// send records read from file to channel (replaces Lines()). this is a
+// wrapper around Next
 func (r *JsonlReader) Records() (ch chan JsonlRecord) {
 	ch = make(chan JsonlRecord)
-	decoder := json.NewDecoder(r.z)
 	go func() {
-		for decoder.More() {
-			var record JsonlRecord // alt: decode to map[string][]byte to include all records
-			if err := decoder.Decode(&record); err != nil {
-				if r.fatal {
-					log.Fatalf("Error decoding record: %v", err)
-				} else {
-					log.Printf("Error decoding record: %v", err)
-				}
-			}
-			if len(record.Text) > 0 {
-				ch <- record
-			}
+		for r.Next() {
+			ch <- r.rec
 		}
+		r.logErr()
 		close(ch)
 	}()
 	return
 }
 
-// output: a channel containing map {outputColumnNames: lines}
+// output: a channel containing map {outputColumnNames: lines}. this is a
+// wrapper around Next, copying each row
 func (r *JsonlReader) Rows() (ch chan map[string][]byte) {
 	ch = make(chan map[string][]byte)
-	src := r.Records()
 	go func() {
-		for {
+		for r.Next() {
 			m := make(map[string][]byte) // this is output map of rows
-			v, ok := <-src
-			if !ok {
-				close(ch)
-				return
-			}
-
-			// we base64 encode to match Paracrawl format
-			b := []byte(v.Text)
-			enc := make([]byte, base64.StdEncoding.EncodedLen((len(b))))
-			base64.StdEncoding.Encode(enc, b)
-
-			m["url"] = []byte(v.Url)
-			m["text"] = enc
-			m["id"] = []byte(v.Id)
+			m["url"] = []byte(r.rec.Url)
+			m["text"] = append([]byte{}, r.enc...)
+			m["id"] = []byte(r.rec.Id)
 			ch <- m
 		}
+		r.logErr()
+		close(ch)
 	}()
 	return ch
 }
+
+func (r *JsonlReader) logErr() {
+	if err := r.Err(); err != nil {
+		if r.fatal {
+			log.Fatalf("Error decoding record: %v", err)
+		} else {
+			log.Printf("Error decoding record: %v", err)
+		}
+	}
+}
+
+// read the next record with text, returning false at the end of the
+// input or on an error, which Err then gives
+func (r *JsonlReader) Next() bool {
+	for r.err == nil && r.lr.Next() {
+		if r.oversized() {
+			continue
+		}
+		line := bytes.TrimSpace(r.lr.Line())
+		if len(line) == 0 {
+			continue
+		}
+		r.rec = JsonlRecord{} // alt: decode to map[string][]byte to include all records
+		if err := json.Unmarshal(line, &r.rec); err != nil {
+			r.err = fmt.Errorf("%v:%d: %w", r.lr.lim.name, r.lr.lim.lineno, err)
+			return false
+		}
+		if len(r.rec.Text) == 0 {
+			continue
+		}
+
+		// we base64 encode to match Paracrawl format
+		n := base64.StdEncoding.EncodedLen(len(r.rec.Text))
+		if cap(r.enc) < n {
+			r.enc = make([]byte, n)
+		}
+		r.enc = r.enc[:n]
+		base64.StdEncoding.Encode(r.enc, []byte(r.rec.Text))
+
+		for c := range r.row {
+			delete(r.row, c)
+		}
+		r.row["url"] = []byte(r.rec.Url)
+		r.row["text"] = r.enc
+		r.row["id"] = []byte(r.rec.Id)
+		return true
+	}
+	if r.err == nil {
+		r.err = r.lr.Err()
+	}
+	return false
+}
+
+// the record read by Next
+func (r *JsonlReader) Record() JsonlRecord {
+	return r.rec
+}
+
+// the row read by Next, with the text base64 encoded. the map and the
+// text are reused, and are only good until the next call to Next
+func (r *JsonlReader) Row() map[string][]byte {
+	return r.row
+}
+
+func (r *JsonlReader) Err() error {
+	return r.err
+}
@@ -2,7 +2,6 @@ package giashard
 
 import (
 	"bufio"
-	"compress/gzip"
 	"errors"
 	"io"
 	"log"
@@ -14,24 +13,55 @@ type LineReader struct {
 	f io.ReadCloser
 	z io.ReadCloser
 	fatal bool
+	buf *bufio.Reader
+	line []byte // the current line, reused
+	done bool
+	err error
+	lim lineLimit // longest line to keep, see oversize.go
 }
 
-// return an object that will read lines out of the gzip compressed file
+// return an object that will read lines out of the gzip compressed file,
+// or zstd compressed if it is named .zst
 func NewLineReader(filename string) (r *LineReader, err error) {
+	return NewLineReaderAt(filename, 0)
+}
+
+// as NewLineReader, but starting at the given offset in the file, which
+// must be the start of a gzip member or zstd frame
+func NewLineReaderAt(filename string, offset int64) (r *LineReader, err error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return
 	}
+	if offset > 0 {
+		if _, err = f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return
+		}
+	}
 
-	z, err := gzip.NewReader(f)
+	z, err := newDecompressor(filename, f)
 	if err != nil {
+		f.Close()
 		return
 	}
 
-	r = &LineReader{f, z, true}
+	r = newLineReader(z, filename)
+	r.f, r.z = f, z
 	return
 }
 
+// read lines from rd, which is left for the caller to close. name is the
+// file read, for messages
+func newLineReader(rd io.Reader, name string) *LineReader {
+	return &LineReader{
+		fatal: true,
+		buf: bufio.NewReader(rd),
+		line: make([]byte, 0, 1024),
+		lim: lineLimit{name: name},
+	}
+}
+
 // should read errors be fatal (and abort the program with log.Fatalf)
 func (r *LineReader)Fatal(flag bool) {
 	r.fatal = flag
@@ -48,46 +78,102 @@ func (r *LineReader)Close() (err error) {
 	return
 }
 
-// send lines read from file to the channel
+// send lines read from file to the channel. this is a wrapper around
+// Next, copying each line
 func (r *LineReader)Lines() (ch chan []byte) {
 	ch = make(chan []byte)
 	go func() {
-		buf := bufio.NewReader(r.z)
-
-		item := make([]byte, 0, 1024)
-		for {
-			line, pfx, err := buf.ReadLine()
-			// we got some bytes, accumulate
-			if len(line) > 0 {
-				item = append(item, line...)
-			}
-			// we're done
-			if err != nil {
-				if err == io.EOF {
-					if len(item) > 0 {
-						ch <- item
-					}
-				} else {
-					var perr *os.PathError
-					if errors.As(err, &perr) && perr.Err.Error() == "file already closed" {
-						// Ignore weird edge case we're we are closing ColReader
-						// so quickly we haven't had the time to encounter EOF
-						// in this LineReader yet.
-					} else if r.fatal {
-						log.Fatalf("error reading column: %v", err)
-					} else {
-						log.Printf("error reading column: %v", err)
-					}
-				}
-				close(ch)
-				return
-			}
-			// if we have a complete line, send it
-			if !pfx {
-				ch <- item
-				item = make([]byte, 0, 1024)
+		for r.Next() {
+			line := r.Line()
+			item := make([]byte, len(line))
+			copy(item, line)
+			ch <- item
+		}
+		if err := r.Err(); err != nil && !closedEarly(err) {
+			if r.fatal {
+				log.Fatalf("error reading column: %v", err)
+			} else {
+				log.Printf("error reading column: %v", err)
 			}
 		}
+		close(ch)
 	}()
 	return
 }
+
+// Ignore weird edge case we're we are closing a reader so quickly that its
+// channel hasn't had the time to encounter EOF yet.
+func closedEarly(err error) bool {
+	var perr *os.PathError
+	return errors.As(err, &perr) && perr.Err.Error() == "file already closed"
+}
+
+// read the next line, returning false at the end of the file or on an
+// error, which Err then gives
+func (r *LineReader)Next() bool {
+	if r.done {
+		return false
+	}
+	r.line = r.line[:0]
+	r.lim.start()
+	for {
+		part, err := r.buf.ReadSlice('\n')
+		if err == nil {
+			part = part[:len(part)-1]
+		}
+		if r.line, r.err = r.lim.add(r.line, part); r.err != nil {
+			r.done = true
+			return false
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && err != io.EOF {
+			r.done = true
+			r.err = err
+			return false
+		}
+		if err == io.EOF {
+			r.done = true
+			if r.lim.size == 0 {
+				return false
+			}
+		}
+		// drop the end of line, as bufio.Reader.ReadLine would
+		if n := len(r.line); n > 0 && r.line[n-1] == '\r' && !r.lim.cut {
+			r.line = r.line[:n-1]
+		}
+		r.err = r.lim.end()
+		return r.err == nil
+	}
+}
+
+// the line read by Next, without its end of line. it is only good until
+// the next call to Next
+func (r *LineReader)Line() []byte {
+	return r.line
+}
+
+// the error that stopped Next, if it was not the end of the file
+func (r *LineReader)Err() error {
+	return r.err
+}
+
+// skip over n lines, returning how many there were
+func (r *LineReader)Skip(n int64) (skipped int64, err error) {
+	for skipped < n {
+		line, err := r.buf.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			continue // the rest of a long line
+		} else if err == io.EOF && len(line) > 0 {
+			skipped++ // a last line without a newline
+		}
+		if err != nil {
+			r.lim.lineno += skipped
+			return skipped, err
+		}
+		skipped++
+	}
+	r.lim.lineno += skipped
+	return
+}
@@ -2,13 +2,29 @@ package giashard
 
 import (
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
 	"io"
 	"os"
 )
 
+// a gzip.Writer, or a zstd.Encoder for columns with a dictionary
+type compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
 type LineWriter struct {
 	f io.WriteCloser
-	z io.WriteCloser
+	z compressor
+	n int64 // uncompressed bytes written
+	off int64 // compressed bytes in the file, as far as flushed
+	par *parallelWriter // if compressing on the shared pool, see compress.go
+	rows int64 // lines written
+	sum hash.Hash // SHA-256 of the compressed file, as far as flushed
+	start int64 // size of the file when opened
+	startSum string // and its SHA-256
 }
 
 func NewLineWriter(filename string) (w *LineWriter, err error) {
@@ -16,19 +32,76 @@ func NewLineWriter(filename string) (w *LineWriter, err error) {
 	if err != nil {
 		return
 	}
-	z, err := gzip.NewWriterLevel(f, gzip.BestCompression)
+	fi, err := f.Stat()
 	if err != nil {
 		f.Close()
 		return
 	}
-	z.Comment = "Written by giashard"
 
-	w = &LineWriter{f, z}
+	// files named .zst are compressed with zstd and the column's
+	// dictionary, if it has one, see dict.go. they don't use the pool
+	w = &LineWriter{f: f, off: fi.Size(), sum: sha256.New(), start: fi.Size()}
+	// the file is hashed as it is written, carrying on from what is there
+	if err = w.hashFile(filename); err != nil {
+		f.Close()
+		return nil, err
+	}
+	_, zst := columnName(filename)
+	level, pool := joinCompression(zst)
+	if pool != nil {
+		w.par = newParallelWriter(pool, w.Write)
+		return
+	}
+	w.z, err = newCompressor(filename, w, level)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return
+}
+
+// count and hash what the compressor writes to the file
+func (w *LineWriter)Write(p []byte) (n int, err error) {
+	n, err = w.f.Write(p)
+	w.off += int64(n)
+	w.sum.Write(p[:n])
+	return
+}
+
+// hash what is in the file already, on appending to it. it is only read
+// through, not decompressed
+func (w *LineWriter)hashFile(filename string) (err error) {
+	if w.start > 0 {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err = io.CopyN(w.sum, f, w.start); err != nil {
+			return err
+		}
+	}
+	w.startSum = hex.EncodeToString(w.sum.Sum(nil))
 	return
 }
 
+// describe the file once the writer is closed, given cm describing it
+// as it was when opened. ok is false if cm doesn't
+func (w *LineWriter)meta(cm ColumnMeta) (_ ColumnMeta, ok bool) {
+	if cm.Compressed != w.start || (w.start > 0 && cm.SHA256 != w.startSum) {
+		return cm, false
+	}
+	cm.Rows += w.rows
+	cm.Bytes += w.n
+	cm.Compressed = w.off
+	cm.SHA256 = hex.EncodeToString(w.sum.Sum(nil))
+	return cm, true
+}
+
 func (w *LineWriter)Close() (err error) {
-	if e := w.z.Close(); e != nil {
+	if w.par != nil {
+		err = w.par.close()
+	} else if e := w.z.Close(); e != nil {
 		err = e
 	}
 	if e := w.f.Close(); e != nil {
@@ -39,6 +112,35 @@ func (w *LineWriter)Close() (err error) {
 
 func (w *LineWriter)WriteLine(line []byte) (err error) {
 	line = append(line, '\n')
-	_, err = w.z.Write(line)
+	w.rows += 1
+	if w.par != nil {
+		w.n += int64(len(line))
+		return w.par.write(line)
+	}
+	n, err := w.z.Write(line)
+	w.n += int64(n)
 	return
 }
+
+// the number of uncompressed bytes written, including newlines
+func (w *LineWriter)Size() int64 {
+	return w.n
+}
+
+// finish the current gzip member or zstd frame and start another,
+// returning the offset in the file at which the new one starts. a reader
+// can start from there without reading what came before
+func (w *LineWriter)NewMember() (offset int64, err error) {
+	if w.par != nil {
+		err = w.par.flush()
+		return w.off, err
+	}
+	if err = w.z.Close(); err != nil {
+		return
+	}
+	w.z.Reset(w)
+	if gz, ok := w.z.(*gzip.Writer); ok {
+		gz.Comment = "Written by giashard"
+	}
+	return w.off, nil
+}
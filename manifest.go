@@ -0,0 +1,208 @@
+package giashard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// name of the manifest file at the top of a sharded tree
+const ManifestName = "manifest.json"
+
+// name of the slug map file, if any, at the top of a sharded tree
+const SlugMapName = "slugmap.tsv"
+
+// The manifest records how a tree was sharded, so that later runs
+// appending to the tree, and tools like giashardid, can reproduce the
+// assignment of urls to shards.
+type Manifest struct {
+	Shards uint            `json:"shards"`           // number of shards (2^n)
+	Key    string          `json:"key"`              // column used for sharding
+	Splits map[string]uint `json:"splits,omitempty"` // hot slugs spread over several shards
+	Map    string          `json:"map,omitempty"`    // slug map file, relative to the tree
+	Pins   []Pin           `json:"pins,omitempty"`   // slugs and hosts pinned to shards
+	Sample *Sampler        `json:"sample,omitempty"` // the tree only holds a sample
+
+	Indexed   bool     `json:"indexed,omitempty"`   // shards keep a url index
+	Canonical []string `json:"canonical,omitempty"` // rules for canonicalising keys
+	Buckets   uint     `json:"buckets,omitempty"`   // buckets per shard, by a second hash of the key
+
+	canonicaliser *Canonicaliser
+	slugmap       SlugMap
+	mapdirty      bool // slug map needs writing out
+	slugpins      map[string]uint64
+}
+
+func NewManifest(n uint, key string) *Manifest {
+	return &Manifest{Shards: n, Key: key, Splits: make(map[string]uint), slugpins: make(map[string]uint64)}
+}
+
+// read the manifest of the tree at dir. if there isn't one, the
+// returned error satisfies errors.Is(err, os.ErrNotExist)
+func ReadManifest(dir string) (m *Manifest, err error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return
+	}
+
+	m = &Manifest{}
+	if err = json.Unmarshal(buf, m); err != nil {
+		return nil, fmt.Errorf("reading manifest of %v: %w", dir, err)
+	}
+	if m.Splits == nil {
+		m.Splits = make(map[string]uint)
+	}
+	if m.Sample != nil {
+		m.Sample.init()
+	}
+	if m.Canonical != nil {
+		if m.canonicaliser, err = NewCanonicaliser(m.Canonical...); err != nil {
+			return nil, fmt.Errorf("reading manifest of %v: %w", dir, err)
+		}
+	}
+	pins := m.Pins
+	m.Pins = nil
+	m.slugpins = make(map[string]uint64)
+	if err = m.Pin(pins...); err != nil {
+		return nil, fmt.Errorf("reading manifest of %v: %w", dir, err)
+	}
+	if m.Map != "" {
+		if m.slugmap, err = ReadSlugMap(filepath.Join(dir, m.Map)); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// read the manifest of the tree at dir, or make a fresh one if the tree
+// doesn't have one yet
+func OpenManifest(dir string, n uint, key string) (m *Manifest, err error) {
+	m, err = ReadManifest(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return NewManifest(n, key), nil
+	} else if err != nil {
+		return
+	}
+
+	if m.Shards != n || m.Key != key {
+		err = fmt.Errorf("%v was sharded into 2^%d shards by %v, not 2^%d by %v", dir, m.Shards, m.Key, n, key)
+		return nil, err
+	}
+	return
+}
+
+// write the manifest to the top of the tree at dir, replacing whatever
+// was there
+func (m *Manifest) Write(dir string) (err error) {
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return
+	}
+	if m.mapdirty {
+		if err = m.slugmap.Write(filepath.Join(dir, m.Map)); err != nil {
+			return
+		}
+		m.mapdirty = false
+	}
+
+	tmp := filepath.Join(dir, ManifestName+".tmp")
+	if err = ioutil.WriteFile(tmp, append(buf, '\n'), 0666); err != nil {
+		return
+	}
+	return os.Rename(tmp, filepath.Join(dir, ManifestName))
+}
+
+// spread slug over k shards. if it has already been spread over more,
+// keep that, since documents may already be sitting in those shards
+func (m *Manifest) Split(slug string, k uint) {
+	if max := uint(1) << m.Shards; k > max {
+		k = max
+	}
+	if k > m.Splits[slug] {
+		m.Splits[slug] = k
+	}
+}
+
+// assign slugs to shards using the slug map rather than the hash. a
+// tree only ever has one slug map, since changing it would move domains
+// that have already been written
+func (m *Manifest) UseSlugMap(sm SlugMap) (err error) {
+	if err = sm.Validate(m.Shards); err != nil {
+		return
+	}
+	if m.slugmap != nil {
+		if !m.slugmap.Equal(sm) {
+			err = fmt.Errorf("the tree already has a different slug map")
+		}
+		return
+	}
+	m.slugmap = sm
+	m.Map = SlugMapName
+	m.mapdirty = true
+	return
+}
+
+// the shard that key, with the given slug, is assigned to. base is the
+// shard computed from the slug alone, as by ShardId. pins take precedence
+// over the slug map, which takes precedence over the hash, and hot slugs
+// are then split starting from there
+func (m *Manifest) assign(slug string, base uint64, key string) uint64 {
+	if id, ok := m.pin(slug, key); ok {
+		return id
+	}
+	if id, ok := m.slugmap[slug]; ok {
+		base = id
+	}
+	if k, ok := m.Splits[slug]; ok && k > 1 {
+		return splitShard(base, key, k, m.Shards)
+	}
+	return base
+}
+
+// the shard that key is assigned to in this tree
+func (m *Manifest) ShardId(key string) (shard uint64, err error) {
+	key = m.canonicalKey(key)
+	slug, err := Slug(key)
+	if err != nil {
+		return
+	}
+	return m.assign(slug, slugShard(slug, m.Shards), key), nil
+}
+
+// all of the shards that documents with the same slug as key may have
+// been assigned to in this tree
+func (m *Manifest) ShardIds(key string) (shards []uint64, err error) {
+	key = m.canonicalKey(key)
+	slug, err := Slug(key)
+	if err != nil {
+		return
+	}
+
+	if id, ok := m.pin(slug, key); ok {
+		return []uint64{id}, nil
+	}
+	return m.slugShards(slug), nil
+}
+
+// the shards the slug is spread over, leaving aside pins
+func (m *Manifest) slugShards(slug string) (shards []uint64) {
+	base := slugShard(slug, m.Shards)
+	if id, ok := m.slugmap[slug]; ok {
+		base = id
+	}
+	k, ok := m.Splits[slug]
+	if !ok || k < 1 {
+		k = 1
+	}
+	for i := uint(0); i < k; i++ {
+		shards = append(shards, (base+uint64(i))%(1<<m.Shards))
+	}
+	return
+}
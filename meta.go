@@ -0,0 +1,243 @@
+package giashard
+
+/*
+Each batch directory gets a metadata sidecar, batch.json, when it is
+sealed. It records the number of rows, and for each column the number of
+rows, the uncompressed and compressed bytes and the SHA-256 of the
+compressed file, together with the inputs that contributed rows, when the
+batch was sealed and by what. VerifyBatch checks a batch against it.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+const BatchMetaName = "batch.json"
+
+type ColumnMeta struct {
+	Rows       int64  `json:"rows"`
+	Bytes      int64  `json:"bytes"`      // uncompressed
+	Compressed int64  `json:"compressed"` // size of the file
+	SHA256     string `json:"sha256"`     // of the file
+}
+
+type BatchMeta struct {
+	Rows    int64                 `json:"rows"`
+	Columns map[string]ColumnMeta `json:"columns"`
+	Sources []string              `json:"sources,omitempty"` // inputs that contributed rows
+	Created time.Time             `json:"created"`
+	Tool    string                `json:"tool"`
+}
+
+// the name and version of the running program
+func toolVersion() string {
+	version := "unknown"
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if bi.Main.Path == "github.com/paracrawl/giashard" {
+			version = bi.Main.Version
+		} else {
+			for _, dep := range bi.Deps {
+				if dep.Path == "github.com/paracrawl/giashard" {
+					version = dep.Version
+				}
+			}
+		}
+	}
+	return filepath.Base(os.Args[0]) + " " + version
+}
+
+// read through the compressed column file to describe it
+func NewColumnMeta(filename string) (cm ColumnMeta, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	counted := &countingReader{r: io.TeeReader(f, hash)}
+	if fi, err := f.Stat(); err != nil {
+		return cm, err
+	} else if fi.Size() == 0 {
+		cm.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		return cm, nil
+	}
+
+	z, err := newDecompressor(filename, bufio.NewReader(counted))
+	if err != nil {
+		return cm, fmt.Errorf("%v: %w", filename, err)
+	}
+	defer z.Close()
+	buf := make([]byte, 64*1024)
+	for {
+		n, e := z.Read(buf)
+		cm.Bytes += int64(n)
+		cm.Rows += int64(bytes.Count(buf[:n], []byte{'\n'}))
+		if e == io.EOF {
+			break
+		} else if e != nil {
+			return cm, fmt.Errorf("%v: %w", filename, e)
+		}
+	}
+	// the gzip reader may stop short of the end of the file
+	if _, err = io.Copy(ioutil.Discard, counted); err != nil {
+		return
+	}
+	cm.Compressed = counted.n
+	cm.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.r.Read(p)
+	cr.n += int64(n)
+	return
+}
+
+// describe the columns of the batch at dir, as it is now
+func NewBatchMeta(dir string, cols []string, sources []string) (m *BatchMeta, err error) {
+	return describeBatch(dir, cols, nil, sources)
+}
+
+// describe the columns of the batch at dir, reading only those that are
+// not already described in known
+func describeBatch(dir string, cols []string, known map[string]ColumnMeta, sources []string) (m *BatchMeta, err error) {
+	m = &BatchMeta{
+		Columns: make(map[string]ColumnMeta),
+		Created: time.Now().UTC().Truncate(time.Second),
+		Tool:    toolVersion(),
+	}
+	for i, c := range cols {
+		cm, ok := known[c]
+		if !ok {
+			if cm, err = NewColumnMeta(ColumnFile(dir, c)); err != nil {
+				return nil, err
+			}
+		}
+		m.Columns[c] = cm
+		if i == 0 || cm.Rows > m.Rows {
+			m.Rows = cm.Rows
+		}
+	}
+	m.Sources = append([]string{}, sources...)
+	sort.Strings(m.Sources)
+	return
+}
+
+func ReadBatchMeta(dir string) (m *BatchMeta, err error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, BatchMetaName))
+	if err != nil {
+		return
+	}
+	m = &BatchMeta{}
+	if err = json.Unmarshal(buf, m); err != nil {
+		return nil, fmt.Errorf("reading metadata of %v: %w", dir, err)
+	}
+	return
+}
+
+func (m *BatchMeta) Write(dir string) (err error) {
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := filepath.Join(dir, BatchMetaName+".tmp")
+	if err = ioutil.WriteFile(tmp, append(buf, '\n'), 0666); err != nil {
+		return
+	}
+	return os.Rename(tmp, filepath.Join(dir, BatchMetaName))
+}
+
+// describe the batch afresh, for all of its columns, keeping the sources
+// of the old metadata along with any new ones
+func RefreshBatchMeta(dir string, sources ...string) (err error) {
+	cols, err := BatchColumns(dir)
+	if err != nil {
+		return
+	}
+	if old, err := ReadBatchMeta(dir); err == nil {
+		sources = mergeSources(old.Sources, sources)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	m, err := NewBatchMeta(dir, cols, sources)
+	if err != nil {
+		return
+	}
+	return m.Write(dir)
+}
+
+func mergeSources(a []string, b []string) (merged []string) {
+	seen := make(map[string]bool)
+	for _, s := range append(append([]string{}, a...), b...) {
+		if !seen[s] {
+			seen[s] = true
+			merged = append(merged, s)
+		}
+	}
+	return
+}
+
+// check the batch at dir against its metadata: every column is there and
+// as described, there are no others, and they all have the same number
+// of rows
+func VerifyBatch(dir string) (err error) {
+	m, err := ReadBatchMeta(dir)
+	if err != nil {
+		return
+	}
+	var problems []string
+	cols, err := BatchColumns(dir)
+	if err != nil {
+		return
+	}
+	for _, c := range cols {
+		if _, ok := m.Columns[c]; !ok {
+			problems = append(problems, fmt.Sprintf("column %v is not in the metadata", c))
+		}
+	}
+
+	names := make([]string, 0, len(m.Columns))
+	for c := range m.Columns {
+		names = append(names, c)
+	}
+	sort.Strings(names)
+	for _, c := range names {
+		want := m.Columns[c]
+		got, err := NewColumnMeta(ColumnFile(dir, c))
+		switch {
+		case err != nil:
+			problems = append(problems, err.Error())
+		case got.SHA256 != want.SHA256:
+			problems = append(problems, fmt.Sprintf("column %v has checksum %v, expected %v", c, got.SHA256, want.SHA256))
+		case got != want:
+			problems = append(problems, fmt.Sprintf("column %v has %d rows and %d bytes, expected %d and %d", c, got.Rows, got.Bytes, want.Rows, want.Bytes))
+		}
+		if want.Rows != m.Rows {
+			problems = append(problems, fmt.Sprintf("column %v has %d rows, batch has %d", c, want.Rows, m.Rows))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("batch %v does not match its metadata: %v", dir, strings.Join(problems, "; "))
+	}
+	return
+}
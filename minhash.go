@@ -0,0 +1,184 @@
+package giashard
+
+/*
+Near-duplicate detection with MinHash. Each document is cut into shingles
+of k consecutive words, and its signature is the minimum of each of n
+hash functions over its shingles. The fraction of equal entries in two
+signatures estimates the Jaccard similarity of their shingle sets.
+Locality sensitive hashing splits the signatures into bands, and only
+documents that agree on a whole band are compared.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+)
+
+type MinHasher struct {
+	k     int      // words per shingle
+	seeds []uint64 // one per hash function
+}
+
+type Signature []uint64
+
+func NewMinHasher(n int, k int, seed int64) *MinHasher {
+	rng := rand.New(rand.NewSource(seed))
+	seeds := make([]uint64, n)
+	for i := range seeds {
+		seeds[i] = rng.Uint64()
+	}
+	if k < 1 {
+		k = 1
+	}
+	return &MinHasher{k, seeds}
+}
+
+// hashes of the k-word shingles of the text. texts shorter than k words
+// are a single shingle
+func (mh *MinHasher) Shingles(text []byte) (shingles []uint64) {
+	words := bytes.Fields(text)
+	for i := 0; i == 0 || i+mh.k <= len(words); i++ {
+		hash := fnv.New64a()
+		for j := i; j < i+mh.k && j < len(words); j++ {
+			hash.Write(words[j])
+			hash.Write([]byte{' '})
+		}
+		shingles = append(shingles, hash.Sum64())
+	}
+	return
+}
+
+func (mh *MinHasher) Signature(text []byte) (sig Signature) {
+	shingles := mh.Shingles(text)
+	sig = make(Signature, len(mh.seeds))
+	for i, seed := range mh.seeds {
+		min := uint64(math.MaxUint64)
+		for _, s := range shingles {
+			if h := mix64(s ^ seed); h < min {
+				min = h
+			}
+		}
+		sig[i] = min
+	}
+	return
+}
+
+// estimated Jaccard similarity of the documents with these signatures
+func (sig Signature) Similarity(other Signature) float64 {
+	same := 0
+	for i := range sig {
+		if sig[i] == other[i] {
+			same++
+		}
+	}
+	return float64(same) / float64(len(sig))
+}
+
+// choose a number of bands, dividing n, for which documents with the
+// given similarity have an even chance of sharing a band
+func LSHBands(n int, threshold float64) (bands int) {
+	bands, best := n, math.Inf(1)
+	for b := 1; b <= n; b++ {
+		if n%b != 0 {
+			continue
+		}
+		r := float64(n / b)
+		if d := math.Abs(math.Pow(1/float64(b), 1/r) - threshold); d < best {
+			bands, best = b, d
+		}
+	}
+	return
+}
+
+// groups documents into clusters of near-duplicates. documents are
+// numbered in the order they are added, and each cluster is identified by
+// its first document
+type LSH struct {
+	threshold float64
+	bands     int
+	rows      int
+	sigs      []Signature
+	buckets   map[uint64][]int
+	parent    []int // union-find
+}
+
+// documents in a bucket beyond this many are not compared against
+const maxBucket = 32
+
+// cluster signatures of n hashes at the given similarity threshold
+func NewLSH(n int, threshold float64) (*LSH, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("signatures need at least 1 hash, not %d", n)
+	}
+	bands := LSHBands(n, threshold)
+	return &LSH{
+		threshold: threshold,
+		bands:     bands,
+		rows:      n / bands,
+		buckets:   make(map[uint64][]int),
+	}, nil
+}
+
+func (l *LSH) Add(sig Signature) (id int) {
+	id = len(l.sigs)
+	l.sigs = append(l.sigs, sig)
+	l.parent = append(l.parent, id)
+
+	var buf [8]byte
+	for b := 0; b < l.bands; b++ {
+		hash := fnv.New64a()
+		binary.LittleEndian.PutUint64(buf[:], uint64(b))
+		hash.Write(buf[:])
+		for _, v := range sig[b*l.rows : (b+1)*l.rows] {
+			binary.LittleEndian.PutUint64(buf[:], v)
+			hash.Write(buf[:])
+		}
+		key := hash.Sum64()
+
+		candidates := l.buckets[key]
+		for _, c := range candidates {
+			if l.find(c) == l.find(id) {
+				continue
+			}
+			if sig.Similarity(l.sigs[c]) >= l.threshold {
+				l.union(c, id)
+			}
+		}
+		if len(candidates) < maxBucket {
+			l.buckets[key] = append(candidates, id)
+		}
+	}
+	return
+}
+
+func (l *LSH) find(i int) int {
+	for l.parent[i] != i {
+		l.parent[i] = l.parent[l.parent[i]]
+		i = l.parent[i]
+	}
+	return i
+}
+
+// the smaller id becomes the root, so that clusters are identified by
+// their first document
+func (l *LSH) union(i, j int) {
+	ri, rj := l.find(i), l.find(j)
+	if ri < rj {
+		l.parent[rj] = ri
+	} else if rj < ri {
+		l.parent[ri] = rj
+	}
+}
+
+// the cluster of the document: the id of the first document in it
+func (l *LSH) Cluster(id int) int {
+	return l.find(id)
+}
+
+func (l *LSH) Len() int {
+	return len(l.sigs)
+}
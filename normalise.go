@@ -0,0 +1,159 @@
+package giashard
+
+/*
+Text normalisation decodes the base64 text column of each row, fixes what
+it can, and encodes it again:
+
+    invalid UTF-8    repaired, replaced or the row dropped
+    control chars    stripped, other than tab and newlines
+    normal form      NFC or NFKC
+
+Repairing takes each byte that is not part of a valid UTF-8 sequence to be
+Windows-1252, by far the most common legacy encoding to be mislabelled as
+UTF-8. Replacing uses U+FFFD instead.
+*/
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/unicode/norm"
+)
+
+type InvalidMode int
+
+const (
+	InvalidRepair  InvalidMode = iota // decode stray bytes as Windows-1252
+	InvalidReplace                    // replace stray bytes with U+FFFD
+	InvalidDrop                       // drop the row
+)
+
+var invalidModes = map[string]InvalidMode{"repair": InvalidRepair, "replace": InvalidReplace, "drop": InvalidDrop}
+
+func ParseInvalidMode(mode string) (m InvalidMode, err error) {
+	m, ok := invalidModes[mode]
+	if !ok {
+		err = fmt.Errorf("unknown invalid UTF-8 mode %v, expected repair, replace or drop", mode)
+	}
+	return
+}
+
+// counts of the fixes made, by row
+type NormaliseSummary struct {
+	NotBase64  int64 `json:"not_base64"` // rows left as they were
+	Repaired   int64 `json:"repaired"`   // rows with invalid UTF-8 repaired
+	Replaced   int64 `json:"replaced"`   // rows with invalid UTF-8 replaced
+	Dropped    int64 `json:"dropped"`    // rows dropped for invalid UTF-8
+	Controls   int64 `json:"controls"`   // rows with control characters stripped
+	Normalised int64 `json:"normalised"` // rows changed by normalisation
+}
+
+type Normaliser struct {
+	col      string
+	form     string // "nfc", "nfkc" or "" for none
+	invalid  InvalidMode
+	controls bool // strip control characters
+
+	summary NormaliseSummary
+}
+
+// normalise the base64 text in col to form, nfc, nfkc or none, dealing
+// with invalid UTF-8 as mode says
+func NewNormaliser(col string, form string, invalid InvalidMode, controls bool) (n *Normaliser, err error) {
+	switch form {
+	case "nfc", "nfkc":
+	case "none":
+		form = ""
+	default:
+		return nil, fmt.Errorf("unknown normal form %v, expected nfc, nfkc or none", form)
+	}
+	return &Normaliser{col: col, form: form, invalid: invalid, controls: controls}, nil
+}
+
+func (n *Normaliser) Summary() *NormaliseSummary {
+	return &n.summary
+}
+
+func (n *Normaliser) scan(row map[string][]byte) (keep bool, err error) {
+	summary := n.summary
+	defer func() { n.summary = summary }()
+	return n.Transform(row)
+}
+
+func (n *Normaliser) Transform(row map[string][]byte) (keep bool, err error) {
+	enc := row[n.col]
+	text := make([]byte, base64.StdEncoding.DecodedLen(len(enc)))
+	size, err := base64.StdEncoding.Decode(text, enc)
+	if err != nil {
+		n.summary.NotBase64++
+		return true, nil
+	}
+	text = text[:size]
+	changed := false
+
+	if !utf8.Valid(text) {
+		switch n.invalid {
+		case InvalidDrop:
+			n.summary.Dropped++
+			return false, nil
+		case InvalidReplace:
+			text = bytes.ToValidUTF8(text, []byte(string(utf8.RuneError)))
+			n.summary.Replaced++
+		default:
+			text = repairUTF8(text)
+			n.summary.Repaired++
+		}
+		changed = true
+	}
+
+	if n.controls {
+		stripped := bytes.Map(func(r rune) rune {
+			if unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r' {
+				return -1
+			}
+			return r
+		}, text)
+		if len(stripped) != len(text) {
+			text = stripped
+			n.summary.Controls++
+			changed = true
+		}
+	}
+
+	var form norm.Form
+	switch n.form {
+	case "nfc":
+		form = norm.NFC
+	case "nfkc":
+		form = norm.NFKC
+	}
+	if n.form != "" && !form.IsNormal(text) {
+		text = form.Bytes(text)
+		n.summary.Normalised++
+		changed = true
+	}
+
+	if changed {
+		row[n.col] = []byte(base64.StdEncoding.EncodeToString(text))
+	}
+	return true, nil
+}
+
+// decode each byte that isn't part of a valid UTF-8 sequence as
+// Windows-1252
+func repairUTF8(text []byte) []byte {
+	out := make([]byte, 0, len(text)+len(text)/2)
+	for len(text) > 0 {
+		r, size := utf8.DecodeRune(text)
+		if r == utf8.RuneError && size <= 1 {
+			r = charmap.Windows1252.DecodeByte(text[0])
+		}
+		out = utf8.AppendRune(out, r)
+		text = text[size:]
+	}
+	return out
+}
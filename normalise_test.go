@@ -0,0 +1,48 @@
+package giashard
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestNormaliser(t *testing.T) {
+	var normcases = [...]struct {
+		form    string
+		invalid InvalidMode
+		text    string
+		keep    bool
+		out     string
+	}{
+		{"nfc", InvalidRepair, "caf\xe9 \x93quoted\x94", true, "café “quoted”"},
+		{"nfc", InvalidReplace, "caf\xe9", true, "caf�"},
+		{"nfc", InvalidDrop, "caf\xe9", false, ""},
+		{"nfc", InvalidDrop, "café", true, "café"},
+		{"nfkc", InvalidDrop, "ﬁne ①", true, "fine 1"},
+		{"none", InvalidDrop, "a\x00b\x07\tc\r\n", true, "ab\tc\r\n"},
+	}
+	for _, tcase := range normcases {
+		n, err := NewNormaliser("text", tcase.form, tcase.invalid, true)
+		if err != nil {
+			t.Fatalf("NewNormaliser: error: %v", err)
+		}
+		row := map[string][]byte{"text": []byte(base64.StdEncoding.EncodeToString([]byte(tcase.text)))}
+		keep, err := n.Transform(row)
+		if err != nil || keep != tcase.keep {
+			t.Errorf("Transform(%q): expected %v got %v, %v", tcase.text, tcase.keep, keep, err)
+			continue
+		}
+		if !keep {
+			continue
+		}
+		out, _ := base64.StdEncoding.DecodeString(string(row["text"]))
+		if string(out) != tcase.out {
+			t.Errorf("Transform(%q): expected %q got %q", tcase.text, tcase.out, out)
+		}
+	}
+
+	n, _ := NewNormaliser("text", "nfc", InvalidRepair, true)
+	n.Transform(map[string][]byte{"text": []byte("not base64!")})
+	if n.Summary().NotBase64 != 1 {
+		t.Errorf("expected one row not in base64, got %v", n.Summary().NotBase64)
+	}
+}
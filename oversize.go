@@ -0,0 +1,329 @@
+package giashard
+
+/*
+A line with no end, as left by a broken dump, would otherwise be read into
+memory whole. Readers can be given a maximum record size, and keep no more
+than that of any line. What happens to the record is up to the mode:
+
+    skip        the row is left out
+    truncate    the row is kept, with the long value cut short
+    quarantine  the row is left out, and written whole to a quarantine
+
+Column readers deal with whole rows, so that the columns stay aligned. A
+JSONL record cut short no longer parses, so can't be truncated.
+
+A quarantine is a directory with a numbered subdirectory for each record,
+holding the row as columns, as in a batch, and quarantine.tsv listing the
+subdirectory, file, line and size of each value that was too long. The
+long values are copied there as they are read, never held in memory.
+*/
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+type OversizeMode int
+
+const (
+	OversizeSkip OversizeMode = iota
+	OversizeTruncate
+	OversizeQuarantine
+)
+
+var oversizeModes = map[string]OversizeMode{"skip": OversizeSkip, "truncate": OversizeTruncate, "quarantine": OversizeQuarantine}
+
+func ParseOversizeMode(mode string) (m OversizeMode, err error) {
+	m, ok := oversizeModes[mode]
+	if !ok {
+		err = fmt.Errorf("unknown oversized record mode %v, expected skip, truncate or quarantine", mode)
+	}
+	return
+}
+
+func (m OversizeMode) String() string {
+	for name, mode := range oversizeModes {
+		if mode == m {
+			return name
+		}
+	}
+	return strconv.Itoa(int(m))
+}
+
+// how much of a line a LineReader keeps
+type lineLimit struct {
+	name   string // the file being read
+	max    int64  // longest line to keep, 0 for no limit
+	lineno int64  // of the current line, from 1
+	size   int64  // of the current line, in full
+	cut    bool   // whether the current line was cut short
+	count  int64  // lines cut short
+
+	spill func() (io.WriteCloser, error) // where long lines are copied, if anywhere
+	w     io.WriteCloser
+}
+
+func (l *lineLimit) start() {
+	l.lineno++
+	l.size = 0
+	l.cut = false
+}
+
+// add the next part of the line, keeping up to max bytes of it
+func (l *lineLimit) add(line []byte, part []byte) (_ []byte, err error) {
+	l.size += int64(len(part))
+	if !l.cut && (l.max <= 0 || int64(len(line)+len(part)) <= l.max) {
+		return append(line, part...), nil
+	}
+	if !l.cut {
+		l.cut = true
+		l.count++
+		if l.spill != nil {
+			if l.w, err = l.spill(); err != nil {
+				return
+			}
+			if _, err = l.w.Write(line); err != nil {
+				return
+			}
+		}
+	}
+	if l.w != nil {
+		if _, err = l.w.Write(part); err != nil {
+			return
+		}
+	}
+	if room := l.max - int64(len(line)); room > 0 {
+		line = append(line, part[:room]...)
+	}
+	return line, nil
+}
+
+func (l *lineLimit) end() (err error) {
+	if l.w != nil {
+		err = l.w.Close()
+		l.w = nil
+	}
+	return
+}
+
+// keep no more than max bytes of any line. the rest of a longer line is
+// read past, and Truncated says so
+func (r *LineReader) MaxLine(max int64) {
+	r.lim.max = max
+}
+
+// whether the current line was longer than allowed, and cut short
+func (r *LineReader) Truncated() bool {
+	return r.lim.cut
+}
+
+// the number of lines cut short so far
+func (r *LineReader) Oversized() int64 {
+	return r.lim.count
+}
+
+type Quarantine struct {
+	dir  string
+	next int
+	log  *os.File
+}
+
+// open a quarantine in dir, adding to any records already there
+func NewQuarantine(dir string) (q *Quarantine, err error) {
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return
+	}
+	records, err := Batches(dir)
+	if err != nil {
+		return
+	}
+	q = &Quarantine{dir: dir, next: 1}
+	if n := len(records); n > 0 {
+		last, _ := strconv.Atoi(filepath.Base(records[n-1]))
+		q.next = last + 1
+	}
+	q.log, err = os.OpenFile(filepath.Join(dir, "quarantine.tsv"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	return
+}
+
+func (q *Quarantine) Close() error {
+	return q.log.Close()
+}
+
+// start a new record
+func (q *Quarantine) record() (rec string, err error) {
+	rec = filepath.Join(q.dir, strconv.Itoa(q.next))
+	q.next++
+	err = os.MkdirAll(rec, os.ModePerm)
+	return
+}
+
+// a column of the record, which is written as it is and ended with a
+// newline when closed
+func (q *Quarantine) column(rec string, col string) (w io.WriteCloser, err error) {
+	f, err := os.Create(filepath.Join(rec, col+".gz"))
+	if err != nil {
+		return
+	}
+	z, err := gzip.NewWriterLevel(f, gzip.BestCompression)
+	if err != nil {
+		f.Close()
+		return
+	}
+	return &quarantineColumn{f, z}, nil
+}
+
+func (q *Quarantine) note(rec string, l *lineLimit) (err error) {
+	_, err = fmt.Fprintf(q.log, "%s\t%s\t%d\t%d\n", filepath.Base(rec), l.name, l.lineno, l.size)
+	return
+}
+
+type quarantineColumn struct {
+	f *os.File
+	z *gzip.Writer
+}
+
+func (qc *quarantineColumn) Write(p []byte) (int, error) {
+	return qc.z.Write(p)
+}
+
+func (qc *quarantineColumn) Close() (err error) {
+	if _, err = qc.z.Write([]byte{'\n'}); err == nil {
+		err = qc.z.Close()
+	}
+	if e := qc.f.Close(); e != nil && err == nil {
+		err = e
+	}
+	return
+}
+
+// what a row or record reader does with records over the limit
+type recordLimit struct {
+	mode  OversizeMode
+	q     *Quarantine
+	rec   string // the quarantine record of the current row, if any
+	count int64  // records over the limit
+}
+
+// the quarantine column for col in the current row's record
+func (rl *recordLimit) spill(col string) func() (io.WriteCloser, error) {
+	return func() (w io.WriteCloser, err error) {
+		if rl.rec == "" {
+			if rl.rec, err = rl.q.record(); err != nil {
+				return
+			}
+		}
+		return rl.q.column(rl.rec, col)
+	}
+}
+
+// say what was done with a line that was too long
+func (rl *recordLimit) report(l *lineLimit) (err error) {
+	log.Printf("Oversized record at %v:%d, %d bytes: %v", l.name, l.lineno, l.size, rl.mode)
+	if rl.mode == OversizeQuarantine {
+		err = rl.q.note(rl.rec, l)
+	}
+	return
+}
+
+// records are rows, of which no value may be longer than max bytes. in
+// quarantine mode, q is where rows with longer values go
+func (r *ColumnReader) MaxRecord(max int64, mode OversizeMode, q *Quarantine) {
+	r.lim = recordLimit{mode: mode, q: q}
+	for i, lr := range r.readers {
+		lr.MaxLine(max)
+		if mode == OversizeQuarantine {
+			lr.lim.spill = r.lim.spill(r.cols[i])
+		}
+	}
+}
+
+// deal with the current row if any of its values was too long, returning
+// whether to leave it out
+func (r *ColumnReader) oversized() (drop bool) {
+	cut := false
+	for _, lr := range r.readers {
+		cut = cut || lr.Truncated()
+	}
+	if !cut {
+		return false
+	}
+	r.lim.count++
+	for _, lr := range r.readers {
+		if lr.Truncated() {
+			if r.err = r.lim.report(&lr.lim); r.err != nil {
+				return true
+			}
+		}
+	}
+	switch r.lim.mode {
+	case OversizeTruncate:
+		return false
+	case OversizeQuarantine:
+		// the long values are there already, add the rest of the row
+		spilled := make(map[string]bool)
+		for i, lr := range r.readers {
+			spilled[r.cols[i]] = lr.Truncated()
+		}
+		for c, v := range r.row {
+			if spilled[c] {
+				continue
+			}
+			w, err := r.lim.q.column(r.lim.rec, c)
+			if err == nil {
+				if _, err = w.Write(v); err == nil {
+					err = w.Close()
+				} else {
+					w.Close()
+				}
+			}
+			if err != nil {
+				r.err = fmt.Errorf("quarantining row of %v: %w", r.dir, err)
+				return true
+			}
+		}
+		r.lim.rec = ""
+	}
+	return true
+}
+
+// the number of rows with values over the limit so far
+func (r *ColumnReader) Oversized() int64 {
+	return r.lim.count
+}
+
+// records are lines, which may be no longer than max bytes. in quarantine
+// mode, q is where longer records go. they can't be truncated
+func (r *JsonlReader) MaxRecord(max int64, mode OversizeMode, q *Quarantine) (err error) {
+	if mode == OversizeTruncate {
+		return fmt.Errorf("JSONL records can't be truncated, they would no longer parse")
+	}
+	r.lim = recordLimit{mode: mode, q: q}
+	r.lr.MaxLine(max)
+	if mode == OversizeQuarantine {
+		r.lr.lim.spill = r.lim.spill("jsonl")
+	}
+	return
+}
+
+// deal with the current record if it was too long, returning whether to
+// leave it out
+func (r *JsonlReader) oversized() (drop bool) {
+	if !r.lr.Truncated() {
+		return false
+	}
+	r.lim.count++
+	r.err = r.lim.report(&r.lr.lim)
+	r.lim.rec = ""
+	return true
+}
+
+// the number of records over the limit so far
+func (r *JsonlReader) Oversized() int64 {
+	return r.lim.count
+}
@@ -0,0 +1,109 @@
+package giashard
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestMaxRecord(t *testing.T) {
+	dir := t.TempDir()
+	long := strings.Repeat("x", 5000)
+	writeColumn(t, dir, "url", 3)
+	w, err := NewLineWriter(filepath.Join(dir, "text.gz"))
+	if err != nil {
+		t.Fatalf("NewLineWriter: error: %v", err)
+	}
+	for _, text := range []string{"short", long, "short"} {
+		w.WriteLine([]byte(text))
+	}
+	w.Close()
+
+	qdir := filepath.Join(t.TempDir(), "quarantine")
+	q, err := NewQuarantine(qdir)
+	if err != nil {
+		t.Fatalf("NewQuarantine: error: %v", err)
+	}
+	defer q.Close()
+
+	for _, mode := range []OversizeMode{OversizeSkip, OversizeTruncate, OversizeQuarantine} {
+		r, err := NewColumnReader(dir, "url", "text")
+		if err != nil {
+			t.Fatalf("NewColumnReader: error: %v", err)
+		}
+		r.MaxRecord(100, mode, q)
+		var urls []string
+		for r.Next() {
+			row := r.Row()
+			if len(row["text"]) > 100 {
+				t.Errorf("%v: expected at most 100 bytes, got %d", mode, len(row["text"]))
+			}
+			urls = append(urls, string(row["url"]))
+		}
+		if err = r.Err(); err != nil {
+			t.Errorf("%v: error: %v", mode, err)
+		}
+		r.Close()
+
+		expected := "[url 0 url 2]"
+		if mode == OversizeTruncate {
+			expected = "[url 0 url 1 url 2]"
+		}
+		if fmt.Sprint(urls) != expected || r.Oversized() != 1 {
+			t.Errorf("%v: expected %v and 1 oversized, got %v and %d", mode, expected, urls, r.Oversized())
+		}
+	}
+
+	// the quarantined row is there whole
+	rows, err := ReadRows(filepath.Join(qdir, "1"), 0, 2, "url", "text")
+	if err != nil {
+		t.Fatalf("ReadRows: error: %v", err)
+	}
+	if len(rows) != 1 || string(rows[0]["url"]) != "url 1" || string(rows[0]["text"]) != long {
+		t.Errorf("expected the quarantined row, got %d rows", len(rows))
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(qdir, "quarantine.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("1\t%s\t2\t5000\n", filepath.Join(dir, "text.gz")); string(buf) != expected {
+		t.Errorf("expected quarantine.tsv to be %q, got %q", expected, buf)
+	}
+}
+
+func TestJsonlMaxRecord(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "text.jsonl.zst")
+	f, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, _ := zstd.NewWriter(f)
+	fmt.Fprintf(z, "{\"u\":\"http://example.com/1\",\"text\":\"%s\",\"id\":\"1\"}\n", strings.Repeat("x", 5000))
+	fmt.Fprintf(z, "{\"u\":\"http://example.com/2\",\"text\":\"hello\",\"id\":\"2\"}\n")
+	z.Close()
+	f.Close()
+
+	r, err := NewJsonlReader(fname)
+	if err != nil {
+		t.Fatalf("NewJsonlReader: error: %v", err)
+	}
+	defer r.Close()
+	if err = r.MaxRecord(100, OversizeTruncate, nil); err == nil {
+		t.Errorf("MaxRecord: expected an error truncating JSONL")
+	}
+	if err = r.MaxRecord(100, OversizeSkip, nil); err != nil {
+		t.Fatalf("MaxRecord: error: %v", err)
+	}
+	var ids []string
+	for r.Next() {
+		ids = append(ids, string(r.Row()["id"]))
+	}
+	if r.Err() != nil || fmt.Sprint(ids) != "[2]" || r.Oversized() != 1 {
+		t.Errorf("expected to skip the first record, got %v, %d oversized, %v", ids, r.Oversized(), r.Err())
+	}
+}
@@ -0,0 +1,134 @@
+package giashard
+
+/*
+Pins guarantee that particular domains land in particular shards, whatever
+the hash, slug map or hot slug splitting would say. A pin file has one
+pattern and shard id per line, separated by whitespace, with # comments:
+
+    # keep the partner's site with shard 17
+    partnersite        17
+    *.example.co.uk    3
+
+A pattern with a dot or a * in it is matched against the host name, using
+the syntax of path.Match, otherwise it is a slug. Host patterns are tried
+in order, before slugs.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type Pin struct {
+	Pattern string `json:"pattern"`
+	Host    bool   `json:"host,omitempty"` // match host names rather than slugs
+	Shard   uint64 `json:"shard"`
+}
+
+func NewPin(pattern string, shard uint64) (p Pin, err error) {
+	p = Pin{strings.ToLower(pattern), strings.ContainsAny(pattern, ".*"), shard}
+	if p.Host {
+		// catch malformed patterns now rather than on every row
+		_, err = path.Match(p.Pattern, "")
+	}
+	return
+}
+
+func ReadPins(filename string) (pins []Pin, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v:%d: expected a pattern and a shard id", filename, lineno)
+		}
+		shard, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: %w", filename, lineno, err)
+		}
+		p, err := NewPin(fields[0], shard)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: %w", filename, lineno, err)
+		}
+		pins = append(pins, p)
+	}
+	err = scanner.Err()
+	return
+}
+
+// pin patterns to shards in this tree. a pattern that is already pinned
+// must stay in the same shard, and every shard must exist
+func (m *Manifest) Pin(pins ...Pin) (err error) {
+	for _, p := range pins {
+		if p.Shard >= 1<<m.Shards {
+			return fmt.Errorf("%v is pinned to shard %d, but there are only %d shards", p.Pattern, p.Shard, 1<<m.Shards)
+		}
+		if old, ok := m.pinned(p); ok {
+			if old.Shard != p.Shard {
+				return fmt.Errorf("%v is already pinned to shard %d, not %d", p.Pattern, old.Shard, p.Shard)
+			}
+			continue
+		}
+		m.Pins = append(m.Pins, p)
+		if !p.Host {
+			m.slugpins[p.Pattern] = p.Shard
+		}
+	}
+	return
+}
+
+func (m *Manifest) pinned(p Pin) (old Pin, ok bool) {
+	for _, old = range m.Pins {
+		if old.Pattern == p.Pattern && old.Host == p.Host {
+			return old, true
+		}
+	}
+	return
+}
+
+func (m *Manifest) hasHostPins() bool {
+	return len(m.Pins) > len(m.slugpins)
+}
+
+// the shard that the slug or host of key is pinned to, if any
+func (m *Manifest) pin(slug string, key string) (shard uint64, ok bool) {
+	if m.hasHostPins() {
+		if host, err := Host(key); err == nil {
+			host = strings.ToLower(host)
+			for _, p := range m.Pins {
+				if p.Host {
+					if match, _ := path.Match(p.Pattern, host); match {
+						return p.Shard, true
+					}
+				}
+			}
+		}
+	}
+	shard, ok = m.slugpins[slug]
+	return
+}
+
+// pin the slugs or hosts matching the patterns to the given shards,
+// overriding every other way of assigning them. the pins are recorded in
+// the manifest of the tree
+func (s *Shard) Pin(pins ...Pin) error {
+	return s.manifest.Pin(pins...)
+}
@@ -0,0 +1,103 @@
+package giashard
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestColumnReaderNext(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewColumnWriter(dir, "url", "text")
+	if err != nil {
+		t.Fatalf("NewColumnWriter: error: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		text := fmt.Sprintf("text %d", i)
+		if i == 2 {
+			text = ""
+		}
+		w.WriteRow(map[string][]byte{"url": []byte(fmt.Sprintf("http://example.com/%d", i)), "text": []byte(text)})
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Close: error: %v", err)
+	}
+
+	r, err := NewColumnReader(dir, "url", "text")
+	if err != nil {
+		t.Fatalf("NewColumnReader: error: %v", err)
+	}
+	n := 0
+	for r.Next() {
+		row := r.Row()
+		if string(row["url"]) != fmt.Sprintf("http://example.com/%d", n) {
+			t.Errorf("row %d: unexpected url %s", n, row["url"])
+		}
+		if n == 2 && len(row["text"]) != 0 {
+			t.Errorf("row 2: expected empty text, got %q", row["text"])
+		}
+		row["extra"] = []byte("x") // gone by the next row
+		if n == 3 {
+			break // stopping early leaves nothing running
+		}
+		n++
+	}
+	if err = r.Err(); err != nil {
+		t.Errorf("Err: %v", err)
+	}
+	if r.Next() && r.Row()["extra"] != nil {
+		t.Errorf("expected the row to be cleared between rows")
+	}
+	r.Close()
+
+	// the channel API copies each row
+	if r, err = NewColumnReader(dir, "url", "text"); err != nil {
+		t.Fatalf("NewColumnReader: error: %v", err)
+	}
+	var rows []map[string][]byte
+	for row := range r.Rows() {
+		rows = append(rows, row)
+	}
+	r.Close()
+	if len(rows) != 5 || string(rows[0]["text"]) != "text 0" || string(rows[4]["text"]) != "text 4" {
+		t.Errorf("unexpected rows from the channel: %q", rows)
+	}
+}
+
+func TestJsonlReaderNext(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "text.jsonl.zst")
+	f, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := zstd.NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.Write([]byte(`{"u":"http://example.com/1","text":"hello","id":"1"}
+{"u":"http://example.com/2","text":"","id":"2"}
+{"u":"http://example.com/3","text":"world","id":"3"}
+{"u":
+`))
+	z.Close()
+	f.Close()
+
+	r, err := NewJsonlReader(fname)
+	if err != nil {
+		t.Fatalf("NewJsonlReader: error: %v", err)
+	}
+	defer r.Close()
+	var ids []string
+	for r.Next() {
+		ids = append(ids, string(r.Row()["id"]))
+	}
+	if fmt.Sprint(ids) != "[1 3]" {
+		t.Errorf("expected the records with text, got %v", ids)
+	}
+	if r.Err() == nil {
+		t.Errorf("expected an error for the truncated record")
+	}
+}
@@ -0,0 +1,233 @@
+package giashard
+
+/*
+Redaction masks personal information in the base64 text column of each
+row, replacing every match of a rule with a placeholder naming the rule,
+such as [EMAIL]. The built in rules are
+
+    email   e-mail addresses
+    iban    IBANs, checked with their check digits
+    ip      IPv4 and IPv6 addresses
+    phone   phone numbers of 7 to 15 digits, other than dates, with an
+            international or trunk prefix, an area code in brackets or
+            at least three groups joined by dashes, dots or slashes
+
+and are applied in that order. Further rules can be read from a file with
+one name and regular expression per line, separated by whitespace, with
+lines starting with # being comments:
+
+    # national insurance numbers
+    nino    \b[A-Z]{2}\d{6}[A-D]\b
+*/
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type RedactRule struct {
+	Name        string
+	Placeholder string
+
+	re    *regexp.Regexp
+	check func(match string) bool // further checks on a match, if any
+}
+
+var date_re = regexp.MustCompile(`^(?:\d{4}[-./]\d{1,2}[-./]\d{1,2}|\d{1,2}[-./]\d{1,2}[-./]\d{4})$`)
+
+var redactRules = []*RedactRule{
+	{Name: "email", re: regexp.MustCompile(`[\p{L}\p{N}._%+\-]+@[\p{L}\p{N}\-]+(?:\.[\p{L}\p{N}\-]+)*\.\p{L}{2,}`)},
+	{Name: "iban", re: regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,4})?\b`), check: validIBAN},
+	{Name: "ip", re: regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b|(?i:\b(?:[0-9a-f]{1,4}:){7}[0-9a-f]{1,4}\b|\b[0-9a-f]{1,4}(?::[0-9a-f]{1,4})*::(?:[0-9a-f]{1,4}(?::[0-9a-f]{1,4})*\b)?|::[0-9a-f]{1,4}(?::[0-9a-f]{1,4})*\b)`), check: validIP},
+	{Name: "phone", re: regexp.MustCompile(`(?:(?:\+|\b00)[1-9]\d{0,2}[\s.\-]?)?(?:\(\d{1,4}\)[\s.\-]?)?\b\d{2,4}(?:[\s.\-/]?\d{2,4}){1,4}\b`), check: validPhone},
+}
+
+func init() {
+	for _, r := range redactRules {
+		r.Placeholder = "[" + strings.ToUpper(r.Name) + "]"
+	}
+}
+
+func validIBAN(match string) bool {
+	iban := strings.ReplaceAll(match, " ", "")
+	if len(iban) < 15 || len(iban) > 34 {
+		return false
+	}
+	// move the country and check digits to the end, letters become 10-35
+	var digits strings.Builder
+	for _, c := range iban[4:] + iban[:4] {
+		if c >= 'A' && c <= 'Z' {
+			digits.WriteString(strconv.Itoa(int(c-'A') + 10))
+		} else {
+			digits.WriteRune(c)
+		}
+	}
+	n, ok := new(big.Int).SetString(digits.String(), 10)
+	return ok && n.Mod(n, big.NewInt(97)).Int64() == 1
+}
+
+func validIP(match string) bool {
+	return net.ParseIP(match) != nil
+}
+
+func validPhone(match string) bool {
+	digits := 0
+	for _, c := range match {
+		if c >= '0' && c <= '9' {
+			digits++
+		}
+	}
+	if digits < 7 || digits > 15 || date_re.MatchString(match) {
+		return false
+	}
+	// otherwise any run of numbers, such as years or an ISBN, would do
+	if strings.HasPrefix(match, "+") || strings.HasPrefix(match, "0") || strings.HasPrefix(match, "(") {
+		return true
+	}
+	groups := strings.FieldsFunc(match, func(c rune) bool { return c == '-' || c == '.' || c == '/' })
+	return len(groups) >= 3
+}
+
+// the names of the built in rules, in the order they are applied
+func RedactRuleNames() (names []string) {
+	for _, r := range redactRules {
+		names = append(names, r.Name)
+	}
+	return
+}
+
+// the built in rules with the given names, or all of them if none are given
+func RedactRules(names ...string) (rules []*RedactRule, err error) {
+	if len(names) == 0 {
+		return redactRules, nil
+	}
+	for _, name := range names {
+		found := false
+		for _, r := range redactRules {
+			if r.Name == name {
+				rules = append(rules, r)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown redaction rule %v, expected one of %v", name, strings.Join(RedactRuleNames(), ", "))
+		}
+	}
+	return
+}
+
+func NewRedactRule(name string, expr string) (r *RedactRule, err error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("redaction rule %v: %w", name, err)
+	}
+	return &RedactRule{Name: name, Placeholder: "[" + strings.ToUpper(name) + "]", re: re}, nil
+}
+
+func ReadRedactRules(filename string) (rules []*RedactRule, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%v:%d: expected a name and a regular expression", filename, lineno)
+		}
+		expr := strings.TrimSpace(line[len(fields[0]):])
+		r, err := NewRedactRule(fields[0], expr)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: %w", filename, lineno, err)
+		}
+		rules = append(rules, r)
+	}
+	err = scanner.Err()
+	return
+}
+
+type Redactor struct {
+	col      string
+	rules    []*RedactRule
+	countcol string // column to write each row's counts to, if any
+
+	counts map[string]int64 // matches of each rule
+}
+
+// redact the base64 text in col with the rules, in order
+func NewRedactor(col string, rules ...*RedactRule) *Redactor {
+	return &Redactor{col: col, rules: rules, counts: make(map[string]int64)}
+}
+
+// write the number of matches of each rule in the row to the named
+// column, as a comma separated list such as email:1,phone:2
+func (rd *Redactor) CountColumn(name string) {
+	rd.countcol = name
+}
+
+// matches of each rule over all rows
+func (rd *Redactor) Counts() map[string]int64 {
+	return rd.counts
+}
+
+// the text with every match replaced, and the number of matches of each rule
+func (rd *Redactor) Redact(text string) (string, map[string]int) {
+	counts := make(map[string]int)
+	for _, r := range rd.rules {
+		text = r.re.ReplaceAllStringFunc(text, func(match string) string {
+			if r.check != nil && !r.check(match) {
+				return match
+			}
+			counts[r.Name]++
+			return r.Placeholder
+		})
+	}
+	return text, counts
+}
+
+func (rd *Redactor) scan(row map[string][]byte) (keep bool, err error) {
+	counts := rd.counts
+	rd.counts = make(map[string]int64)
+	defer func() { rd.counts = counts }()
+	return rd.Transform(row)
+}
+
+func (rd *Redactor) Transform(row map[string][]byte) (keep bool, err error) {
+	var counts map[string]int
+	if text, err := base64.StdEncoding.DecodeString(string(row[rd.col])); err == nil {
+		var redacted string
+		if redacted, counts = rd.Redact(string(text)); len(counts) > 0 {
+			row[rd.col] = []byte(base64.StdEncoding.EncodeToString([]byte(redacted)))
+		}
+	}
+
+	names := make([]string, 0, len(counts))
+	for name, n := range counts {
+		rd.counts[name] += int64(n)
+		names = append(names, name)
+	}
+	if rd.countcol != "" {
+		sort.Strings(names)
+		for i, name := range names {
+			names[i] = name + ":" + strconv.Itoa(counts[name])
+		}
+		row[rd.countcol] = []byte(strings.Join(names, ","))
+	}
+	return true, nil
+}
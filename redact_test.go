@@ -0,0 +1,44 @@
+package giashard
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	rules, err := RedactRules()
+	if err != nil {
+		t.Fatalf("RedactRules: error: %v", err)
+	}
+	rd := NewRedactor("text", rules...)
+
+	var redactcases = [...]struct {
+		text string
+		out  string
+	}{
+		{"mail jan.de-vries@example.co.uk now", "mail [EMAIL] now"},
+		{"call +44 20 7946 0958 or (020) 7946-0958", "call [PHONE] or [PHONE]"},
+		{"on 2021-10-19 at 10:30, page 12", "on 2021-10-19 at 10:30, page 12"},
+		{"from 192.168.1.20 and 2001:db8::ff00:42:8329", "from [IP] and [IP]"},
+		{"version 1.2.3.4000", "version 1.2.3.4000"},
+		{"pay GB82 WEST 1234 5698 7654 32 today", "pay [IBAN] today"},
+		{"not GB84 WEST ABCD EFGH IJ", "not GB84 WEST ABCD EFGH IJ"},
+		{"use std::vector and Foo::Bar", "use std::vector and Foo::Bar"},
+		{"loopback ::1 or fe80::1", "loopback [IP] or [IP]"},
+		{"call 1990 2000 2010", "call 1990 2000 2010"},
+		{"ISBN 978 0 306 40615 7", "ISBN 978 0 306 40615 7"},
+		{"call 555-123-4567 or 020 7946 0958", "call [PHONE] or [PHONE]"},
+	}
+	for _, tcase := range redactcases {
+		if out, _ := rd.Redact(tcase.text); out != tcase.out {
+			t.Errorf("Redact(%q): expected %q got %q", tcase.text, tcase.out, out)
+		}
+	}
+
+	rd.CountColumn("redactions")
+	row := map[string][]byte{"text": []byte(base64.StdEncoding.EncodeToString([]byte("a@b.org, c@d.org, 10.0.0.1")))}
+	rd.Transform(row)
+	if got := string(row["redactions"]); got != "email:2,ip:1" {
+		t.Errorf("expected counts email:2,ip:1 got %v", got)
+	}
+}
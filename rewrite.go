@@ -0,0 +1,160 @@
+package giashard
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// the numbered batch directories in a shard, in numerical order
+func Batches(shard string) (batches []string, err error) {
+	f, err := os.Open(shard)
+	if err != nil {
+		return
+	}
+	finfos, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return
+	}
+
+	numbers := make([]int, 0, len(finfos))
+	for _, fi := range finfos {
+		if !fi.IsDir() {
+			continue
+		}
+		i, err := strconv.Atoi(fi.Name())
+		if err != nil {
+			// not named numerically, just skip
+			continue
+		}
+		numbers = append(numbers, i)
+	}
+	sort.Ints(numbers)
+
+	for _, i := range numbers {
+		batches = append(batches, filepath.Join(shard, strconv.Itoa(i)))
+	}
+	return
+}
+
+// the columns present in a batch directory, in alphabetical order
+func BatchColumns(dir string) (cols []string, err error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.gz"))
+	if err != nil {
+		return
+	}
+	zst, err := filepath.Glob(filepath.Join(dir, "*.zst"))
+	if err != nil {
+		return
+	}
+	for _, m := range append(matches, zst...) {
+		if filepath.Base(m) == "stats.json.gz" {
+			continue // written by giastat
+		}
+		col, _ := columnName(m)
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+	return
+}
+
+// rewrite the batch at dir, passing each row, numbered from 0, through
+// fn. fn may change the row in place, and returns false to drop it. the
+// row is only good until fn returns. the new batch is written alongside
+// and only replaces the old one once it is complete, so a failure leaves
+// the old batch as it was
+func RewriteBatch(dir string, cols []string, fn func(i int64, row map[string][]byte) (keep bool, err error)) (kept int64, dropped int64, err error) {
+	return RewriteBatchColumns(dir, cols, cols, fn)
+}
+
+// as RewriteBatch, but reading the columns in and writing the columns out,
+// so that fn can add columns. columns that are not written are removed
+func RewriteBatchColumns(dir string, in []string, out []string, fn func(i int64, row map[string][]byte) (keep bool, err error)) (kept int64, dropped int64, err error) {
+	tmp := dir + ".rewrite"
+	if err = os.RemoveAll(tmp); err != nil {
+		return
+	}
+	if err = os.MkdirAll(tmp, os.ModePerm); err != nil {
+		return
+	}
+
+	r, err := NewColumnReader(dir, in...)
+	if err != nil {
+		return
+	}
+	w, err := NewColumnWriter(tmp, out...)
+	if err != nil {
+		r.Close()
+		return
+	}
+	// keep the row index, if the batch has one
+	if ix, e := ReadRowIndex(dir); e == nil {
+		err = w.IndexRows(ix.Every, 0)
+	} else if !os.IsNotExist(e) {
+		log.Printf("Dropping the row index of %v: %v", dir, e)
+	}
+	if err != nil {
+		r.Close()
+		w.Close()
+		os.RemoveAll(tmp)
+		return
+	}
+
+	i := int64(0)
+	for r.Next() {
+		row := r.Row()
+		keep, e := fn(i, row)
+		i++
+		if e != nil {
+			err = e
+			break
+		}
+		if !keep {
+			dropped++
+			continue
+		}
+		if err = w.WriteRow(row); err != nil {
+			break
+		}
+		kept++
+	}
+	if e := r.Err(); e != nil && err == nil {
+		err = e
+	}
+	if e := r.Close(); e != nil && err == nil {
+		err = e
+	}
+	if e := w.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err == nil {
+		var sources []string
+		if old, e := ReadBatchMeta(dir); e == nil {
+			sources = old.Sources
+		}
+		var m *BatchMeta
+		if m, err = NewBatchMeta(tmp, out, sources); err == nil {
+			err = m.Write(tmp)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return
+	}
+
+	// swap the new batch in for the old
+	old := dir + ".old"
+	if err = os.Rename(dir, old); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, dir); err != nil {
+		return
+	}
+	if e := os.RemoveAll(old); e != nil {
+		log.Printf("Error removing old batch %v: %v", old, e)
+	}
+	return
+}
@@ -0,0 +1,207 @@
+package giashard
+
+/*
+A row index lets a reader start part way through a batch rather than
+decompressing each column from the beginning. Every N rows, the column
+writer finishes the gzip member of each column and starts another, and
+records in rows.idx the row number and the offset of the new member in
+each column file:
+
+    every	1000
+    row	url	mime	plain_text
+    1000	81234	4301	2309812
+    2000	162580	8655	4620117
+
+A gzip file made of several members decompresses to the same lines as one
+made of a single member, so readers that know nothing of the index are
+unaffected. Row 0 always starts at offset 0, and is not listed.
+
+Appending to a column without the index, as giamerge does, leaves the
+entries that are there correct. The rows after the last entry are found by
+reading on from it.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const RowIndexName = "rows.idx"
+
+type RowIndex struct {
+	Every   int64
+	Cols    []string
+	Rows    []int64   // row number of each entry
+	Offsets [][]int64 // offset in each column file, for each entry
+}
+
+// read the row index of the batch at dir
+func ReadRowIndex(dir string) (ix *RowIndex, err error) {
+	fname := filepath.Join(dir, RowIndexName)
+	f, err := os.Open(fname)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	ix = &RowIndex{}
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		fields := strings.Split(scanner.Text(), "\t")
+		switch {
+		case lineno == 1:
+			if len(fields) != 2 || fields[0] != "every" {
+				return nil, fmt.Errorf("%v:%d: expected the interval between entries", fname, lineno)
+			}
+			if ix.Every, err = strconv.ParseInt(fields[1], 10, 64); err != nil || ix.Every < 1 {
+				return nil, fmt.Errorf("%v:%d: bad interval %v", fname, lineno, fields[1])
+			}
+		case lineno == 2:
+			if len(fields) < 2 || fields[0] != "row" {
+				return nil, fmt.Errorf("%v:%d: expected the names of the columns", fname, lineno)
+			}
+			ix.Cols = fields[1:]
+		case len(fields) == len(ix.Cols)+1:
+			nums := make([]int64, len(fields))
+			for i, field := range fields {
+				if nums[i], err = strconv.ParseInt(field, 10, 64); err != nil {
+					return nil, fmt.Errorf("%v:%d: %w", fname, lineno, err)
+				}
+			}
+			if n := len(ix.Rows); n > 0 && nums[0] <= ix.Rows[n-1] {
+				return nil, fmt.Errorf("%v:%d: rows out of order", fname, lineno)
+			}
+			ix.Rows = append(ix.Rows, nums[0])
+			ix.Offsets = append(ix.Offsets, nums[1:])
+		default:
+			// a partly written last line is left by a writer that did
+			// not finish. anywhere else, the index is damaged
+			if scanner.Scan() {
+				return nil, fmt.Errorf("%v:%d: expected %d fields", fname, lineno, len(ix.Cols)+1)
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if lineno < 2 {
+		return nil, fmt.Errorf("%v: truncated", fname)
+	}
+	return
+}
+
+// the nearest row at or before row that a reader of col can start from,
+// and the offset in the column file to start at
+func (ix *RowIndex) Seek(col string, row int64) (start int64, offset int64) {
+	if ix == nil {
+		return
+	}
+	ci := -1
+	for i, c := range ix.Cols {
+		if c == col {
+			ci = i
+		}
+	}
+	if ci < 0 {
+		return
+	}
+	i := sort.Search(len(ix.Rows), func(i int) bool { return ix.Rows[i] > row })
+	if i == 0 {
+		return
+	}
+	return ix.Rows[i-1], ix.Offsets[i-1][ci]
+}
+
+// the last entry, or row 0 if there are none
+func (ix *RowIndex) last() (row int64, offsets []int64) {
+	if n := len(ix.Rows); n > 0 {
+		return ix.Rows[n-1], ix.Offsets[n-1]
+	}
+	return 0, make([]int64, len(ix.Cols))
+}
+
+func (ix *RowIndex) header() string {
+	return fmt.Sprintf("every\t%d\nrow\t%s\n", ix.Every, strings.Join(ix.Cols, "\t"))
+}
+
+func formatRowIndexEntry(row int64, offsets []int64) string {
+	var sb strings.Builder
+	sb.WriteString(strconv.FormatInt(row, 10))
+	for _, off := range offsets {
+		sb.WriteByte('\t')
+		sb.WriteString(strconv.FormatInt(off, 10))
+	}
+	sb.WriteByte('\n')
+	return sb.String()
+}
+
+// open a column reader for the batch at dir positioned at the given row,
+// using the batch's row index where there is one. columns the index does
+// not cover are read from the start
+func NewColumnReaderAt(dir string, row int64, cols ...string) (r *ColumnReader, err error) {
+	ix, err := ReadRowIndex(dir)
+	if os.IsNotExist(err) {
+		ix, err = nil, nil
+	} else if err != nil {
+		return
+	}
+
+	r = newColumnReader(dir, cols, make([]*LineReader, 0, len(cols)))
+	for _, c := range cols {
+		start, offset := ix.Seek(c, row)
+		fname := ColumnFile(dir, c)
+		lr, err := NewLineReaderAt(fname, offset)
+		if err == nil {
+			var skipped int64
+			skipped, err = lr.Skip(row - start)
+			r.counts[len(r.readers)] = start + skipped
+			if err == io.EOF {
+				err = nil // past the end, there is nothing to read
+			} else if err != nil {
+				lr.Close()
+			}
+		}
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("seeking to row %d of %v: %w", row, fname, err)
+		}
+		r.readers = append(r.readers, lr)
+	}
+	return
+}
+
+// read n rows of the batch at dir, starting at row from. fewer are
+// returned if the batch ends first
+func ReadRows(dir string, from int64, n int64, cols ...string) (rows []map[string][]byte, err error) {
+	r, err := NewColumnReaderAt(dir, from, cols...)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	for ; n > 0 && r.Next(); n-- {
+		row := make(map[string][]byte, len(cols))
+		for c, v := range r.Row() {
+			row[c] = append([]byte{}, v...)
+		}
+		rows = append(rows, row)
+	}
+	if err = r.Err(); err != nil {
+		return nil, fmt.Errorf("reading %v: %w", dir, err)
+	}
+	return
+}
+
+// keep a row index in every batch, with an entry every n rows. must be
+// called before any rows are written
+func (s *Shard) RowIndex(n int64) {
+	s.rowindex = n
+}
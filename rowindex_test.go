@@ -0,0 +1,118 @@
+package giashard
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func writeIndexedRows(t *testing.T, dir string, from int, to int) {
+	b, err := NewBatch(dir, 1<<20, "id", "text")
+	if err != nil {
+		t.Fatalf("NewBatch: error: %v", err)
+	}
+	if err = b.IndexRows(4); err != nil {
+		t.Fatalf("IndexRows: error: %v", err)
+	}
+	for i := from; i < to; i++ {
+		row := map[string][]byte{"id": []byte(fmt.Sprint(i)), "text": []byte(fmt.Sprintf("text of row %d", i))}
+		if err = b.WriteRow(row); err != nil {
+			t.Fatalf("WriteRow: error: %v", err)
+		}
+	}
+	if err = b.Close(); err != nil {
+		t.Fatalf("Close: error: %v", err)
+	}
+}
+
+func checkRows(t *testing.T, dir string, from int64, n int64, expected ...int) {
+	rows, err := ReadRows(dir, from, n, "text", "id")
+	if err != nil {
+		t.Fatalf("ReadRows(%d, %d): error: %v", from, n, err)
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("ReadRows(%d, %d): expected %d rows, got %d", from, n, len(expected), len(rows))
+	}
+	for i, row := range rows {
+		if string(row["id"]) != fmt.Sprint(expected[i]) || string(row["text"]) != fmt.Sprintf("text of row %d", expected[i]) {
+			t.Errorf("ReadRows(%d, %d): expected row %d, got %s %q", from, n, expected[i], row["id"], row["text"])
+		}
+	}
+}
+
+func TestRowIndex(t *testing.T) {
+	dir := t.TempDir()
+	writeIndexedRows(t, dir, 0, 10)
+	// appending starts a member of its own
+	writeIndexedRows(t, dir, 10, 15)
+
+	batch := filepath.Join(dir, "1")
+	ix, err := ReadRowIndex(batch)
+	if err != nil {
+		t.Fatalf("ReadRowIndex: error: %v", err)
+	}
+	if fmt.Sprint(ix.Rows) != "[4 8 10 12]" {
+		t.Errorf("expected entries for rows 4, 8, 10 and 12, got %v", ix.Rows)
+	}
+	if start, offset := ix.Seek("text", 7); start != 4 || offset != ix.Offsets[0][1] {
+		t.Errorf("Seek(7): expected row 4 at %d, got row %d at %d", ix.Offsets[0][1], start, offset)
+	}
+
+	checkRows(t, batch, 0, 2, 0, 1)
+	checkRows(t, batch, 5, 3, 5, 6, 7)
+	checkRows(t, batch, 11, 10, 11, 12, 13, 14)
+	checkRows(t, batch, 20, 1)
+
+	// rewriting the batch keeps the index, and it still agrees
+	_, _, err = RewriteBatch(batch, []string{"id", "text"}, func(i int64, row map[string][]byte) (bool, error) {
+		return i%2 == 0, nil
+	})
+	if err != nil {
+		t.Fatalf("RewriteBatch: error: %v", err)
+	}
+	if ix, err = ReadRowIndex(batch); err != nil || fmt.Sprint(ix.Rows) != "[4]" {
+		t.Errorf("expected the rewritten batch to have an entry for row 4, got %+v, %v", ix, err)
+	}
+	checkRows(t, batch, 3, 3, 6, 8, 10)
+
+	// and readers that know nothing of it see all the rows
+	r, err := NewColumnReader(batch, "id")
+	if err != nil {
+		t.Fatalf("NewColumnReader: error: %v", err)
+	}
+	n := 0
+	for range r.Rows() {
+		n++
+	}
+	r.Close()
+	if n != 8 {
+		t.Errorf("expected 8 rows, got %d", n)
+	}
+
+	// appending at a multiple of the interval, past the last entry,
+	// starts the member there once
+	dir = t.TempDir()
+	writeIndexedRows(t, dir, 0, 8)
+	writeIndexedRows(t, dir, 8, 12)
+	if ix, err = ReadRowIndex(filepath.Join(dir, "1")); err != nil || fmt.Sprint(ix.Rows) != "[4 8]" {
+		t.Errorf("expected entries for rows 4 and 8, got %+v, %v", ix, err)
+	}
+	checkRows(t, filepath.Join(dir, "1"), 9, 2, 9, 10)
+
+	// reopening with a column more starts the index again
+	dir = t.TempDir()
+	writeIndexedRows(t, dir, 0, 6)
+	w, err := NewColumnWriter(filepath.Join(dir, "1"), "id", "text", "extra")
+	if err != nil {
+		t.Fatalf("NewColumnWriter: error: %v", err)
+	}
+	if err = w.IndexRows(4, 6); err != nil {
+		t.Errorf("IndexRows: error: %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Close: error: %v", err)
+	}
+	if ix, err = ReadRowIndex(filepath.Join(dir, "1")); err != nil || fmt.Sprint(ix.Cols) != "[id text extra]" {
+		t.Errorf("expected an index of id, text and extra, got %+v, %v", ix, err)
+	}
+}
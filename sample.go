@@ -0,0 +1,84 @@
+package giashard
+
+/*
+A sampler keeps a fixed fraction of rows, chosen by a seeded hash of a key
+so that the same rows are chosen on every run and for every language. The
+key can be the slug, which keeps either all or none of a domain, or any
+column such as url or id.
+*/
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+type Sampler struct {
+	Key      string  `json:"key"` // "slug" or a column name
+	Fraction float64 `json:"fraction"`
+	Seed     uint64  `json:"seed"`
+
+	threshold uint64
+}
+
+func NewSampler(key string, fraction float64, seed uint64) (sp *Sampler, err error) {
+	if !(fraction > 0 && fraction <= 1) {
+		return nil, fmt.Errorf("sampling fraction %v is not in (0, 1]", fraction)
+	}
+	if key == "" {
+		return nil, fmt.Errorf("no key given to sample by")
+	}
+	sp = &Sampler{Key: key, Fraction: fraction, Seed: seed}
+	sp.init()
+	return
+}
+
+func (sp *Sampler) init() {
+	if sp.Fraction >= 1 {
+		sp.threshold = math.MaxUint64
+	} else {
+		sp.threshold = uint64(math.Ldexp(sp.Fraction, 64))
+	}
+}
+
+func (sp *Sampler) Equal(other *Sampler) bool {
+	return sp.Key == other.Key && sp.Fraction == other.Fraction && sp.Seed == other.Seed
+}
+
+// should the row, with the given slug, be kept in the sample
+func (sp *Sampler) Keep(slug string, row map[string][]byte) bool {
+	var seed [8]byte
+	binary.LittleEndian.PutUint64(seed[:], sp.Seed)
+
+	hash := fnv.New64a()
+	hash.Write(seed[:])
+	if sp.Key == "slug" {
+		hash.Write([]byte(slug))
+	} else {
+		hash.Write(row[sp.Key])
+	}
+	return mix64(hash.Sum64()) < sp.threshold
+}
+
+// fnv barely stirs the high bits when keys differ only at the end, as
+// urls tend to, so scramble them with the splitmix64 finaliser before
+// comparing against a threshold
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// only keep the rows chosen by the sampler. the sampling parameters are
+// recorded in the manifest, and a tree can only hold one sample
+func (s *Shard) Sample(sp *Sampler) (err error) {
+	if old := s.manifest.Sample; old != nil && !old.Equal(sp) {
+		return fmt.Errorf("the tree already holds a sample by %v of %v with seed %d", old.Key, old.Fraction, old.Seed)
+	}
+	s.manifest.Sample = sp
+	return
+}
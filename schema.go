@@ -0,0 +1,101 @@
+package giashard
+
+/*
+The columns given to NewColumnReader may rename a column and mark it
+optional, to read input directories that don't all follow one layout:
+
+    url                 url.gz, which must be there
+    text=plain_text     text.gz, read as plain_text
+    mime?               mime.gz, or empty values if it isn't there
+    mime?text/html      mime.gz, or text/html if it isn't there
+    text=plain_text?    both
+
+A column that is optional and missing is filled in with its default for
+every row, and doesn't count towards the number of rows.
+*/
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+type ColumnSpec struct {
+	In       string // name of the file, without .gz
+	Out      string // name of the column in the rows read
+	Optional bool
+	Default  []byte // value of a missing optional column
+}
+
+// parse a column of the form in=out?default
+func ParseColumnSpec(spec string) (cs ColumnSpec, err error) {
+	name := spec
+	if i := strings.Index(spec, "?"); i >= 0 {
+		name, cs.Optional, cs.Default = spec[:i], true, []byte(spec[i+1:])
+	}
+	cs.In, cs.Out = name, name
+	if i := strings.Index(name, "="); i >= 0 {
+		cs.In, cs.Out = name[:i], name[i+1:]
+	}
+	if cs.In == "" || cs.Out == "" || strings.ContainsAny(cs.Out, "=/") || strings.Contains(cs.In, "/") {
+		err = fmt.Errorf("bad column %q, expected in=out?default", spec)
+	}
+	return
+}
+
+func ParseSchema(specs ...string) (schema []ColumnSpec, err error) {
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		cs, err := ParseColumnSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		if seen[cs.Out] {
+			return nil, fmt.Errorf("column %v is given more than once", cs.Out)
+		}
+		seen[cs.Out] = true
+		schema = append(schema, cs)
+	}
+	return
+}
+
+// the names of the columns in the rows read
+func SchemaColumns(schema []ColumnSpec) (cols []string) {
+	for _, cs := range schema {
+		cols = append(cols, cs.Out)
+	}
+	return
+}
+
+// as NewColumnReader, for columns already parsed
+func NewSchemaReader(dir string, schema ...ColumnSpec) (r *ColumnReader, err error) {
+	var names, cols []string
+	var readers []*LineReader
+	fill := make(map[string][]byte)
+	for _, cs := range schema {
+		fname := ColumnFile(dir, cs.In)
+		lr, err := NewLineReader(fname)
+		if err != nil && cs.Optional && os.IsNotExist(err) {
+			fill[cs.Out] = cs.Default
+			continue
+		}
+		if err != nil {
+			for _, lr := range readers {
+				if e := lr.Close(); e != nil {
+					log.Print(e)
+				}
+			}
+			return nil, err
+		}
+		names = append(names, cs.In)
+		cols = append(cols, cs.Out)
+		readers = append(readers, lr)
+	}
+	if len(readers) == 0 {
+		return nil, fmt.Errorf("none of the columns are in %v", dir)
+	}
+	r = newColumnReader(dir, cols, readers)
+	r.names, r.fill = names, fill
+	return
+}
@@ -0,0 +1,68 @@
+package giashard
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestParseColumnSpec(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected string
+	}{
+		{"url", "{url url false }"},
+		{"text=plain_text", "{text plain_text false }"},
+		{"mime?", "{mime mime true }"},
+		{"mime?text/html", "{mime mime true text/html}"},
+		{"text=plain_text?a=b", "{text plain_text true a=b}"},
+	}
+	for _, test := range tests {
+		cs, err := ParseColumnSpec(test.spec)
+		if err != nil {
+			t.Errorf("ParseColumnSpec(%q): error: %v", test.spec, err)
+			continue
+		}
+		if got := fmt.Sprintf("{%v %v %v %s}", cs.In, cs.Out, cs.Optional, cs.Default); got != test.expected {
+			t.Errorf("ParseColumnSpec(%q): expected %v, got %v", test.spec, test.expected, got)
+		}
+	}
+	for _, spec := range []string{"", "=url", "text=", "a=b=c", "../url"} {
+		if _, err := ParseColumnSpec(spec); err == nil {
+			t.Errorf("ParseColumnSpec(%q): expected an error", spec)
+		}
+	}
+	if _, err := ParseSchema("text=plain_text", "plain_text"); err == nil {
+		t.Errorf("ParseSchema: expected an error for a column given twice")
+	}
+}
+
+func TestSchemaReader(t *testing.T) {
+	dir := t.TempDir()
+	writeColumn(t, dir, "url", 3)
+	writeColumn(t, dir, "text", 3)
+
+	r, err := NewColumnReader(dir, "url", "text=plain_text", "mime?text/html", "lang?")
+	if err != nil {
+		t.Fatalf("NewColumnReader: error: %v", err)
+	}
+	n := 0
+	for r.Next() {
+		row := r.Row()
+		if string(row["plain_text"]) != fmt.Sprintf("text %d", n) || string(row["mime"]) != "text/html" {
+			t.Errorf("row %d: unexpected %q", n, row)
+		}
+		if v, ok := row["lang"]; !ok || len(v) != 0 {
+			t.Errorf("row %d: expected an empty lang, got %q", n, v)
+		}
+		n++
+	}
+	r.Close()
+	if err = r.Err(); err != nil || n != 3 {
+		t.Errorf("expected 3 rows, got %d, %v", n, err)
+	}
+
+	if _, err = NewColumnReader(dir, "url", "mime"); !os.IsNotExist(err) {
+		t.Errorf("expected a missing column to be an error unless optional, got %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package giashard
+
+import (
+	"os"
+)
+
+// what is known of a batch once it has been sealed, that is closed, on
+// rotation or when the writer is closed
+type SealedBatch struct {
+	Path       string           `json:"path"`
+	Shard      uint64           `json:"shard"`
+	Batch      int              `json:"batch"`
+	Rows       int64            `json:"rows"` // rows in the batch, or written to it if not counted
+	Columns    []string         `json:"columns"`
+	Bytes      map[string]int64 `json:"bytes"`      // uncompressed bytes written to each column
+	Compressed map[string]int64 `json:"compressed"` // size of each column's file
+	Rewritten  bool             `json:"rewritten,omitempty"` // sealed again after rows were removed
+}
+
+type SealHook func(sb *SealedBatch) error
+
+// call hook with each batch as it is sealed. an error from the hook is
+// returned from WriteRow or Close
+func (b *Batch) OnSeal(hook SealHook) {
+	b.hook = hook
+}
+
+// close the current batch, write its metadata and tell the hook about it.
+// the columns written are described from what the writer counted and
+// hashed on the way, so that they need not be read again; only columns
+// the batch had already that were not written to, or that were changed
+// since the old metadata was written, are read
+func (b *Batch) seal() (err error) {
+	w := b.writer
+	b.writer = nil
+	if err = w.Close(); err != nil {
+		return
+	}
+
+	sources := make([]string, 0, len(b.sources))
+	for source := range b.sources {
+		sources = append(sources, source)
+	}
+	b.sources = make(map[string]bool)
+	dir := b.batchPath()
+	old, err := ReadBatchMeta(dir)
+	if err == nil {
+		sources = mergeSources(old.Sources, sources)
+	} else if os.IsNotExist(err) {
+		old = nil
+	} else {
+		return
+	}
+	cols, err := BatchColumns(dir)
+	if err != nil {
+		return
+	}
+	m, err := describeBatch(dir, cols, w.meta(old), sources)
+	if err != nil {
+		return
+	}
+	if err = m.Write(dir); err != nil {
+		return
+	}
+	if b.hook == nil {
+		return
+	}
+
+	sizes := w.Sizes()
+	sb := &SealedBatch{
+		Path:       dir,
+		Batch:      b.number,
+		Rows:       b.rows,
+		Columns:    b.cols,
+		Bytes:      make(map[string]int64),
+		Compressed: make(map[string]int64),
+	}
+	for i, c := range b.cols {
+		sb.Bytes[c] = sizes[i]
+		sb.Compressed[c] = m.Columns[c].Compressed
+	}
+	return b.hook(sb)
+}
+
+// describe a batch that was rewritten as a whole, from its metadata
+func resealedBatch(dir string, number int, cols []string) (sb *SealedBatch, err error) {
+	m, err := ReadBatchMeta(dir)
+	if err != nil {
+		return
+	}
+	sb = &SealedBatch{
+		Path:       dir,
+		Batch:      number,
+		Rows:       m.Rows,
+		Columns:    cols,
+		Bytes:      make(map[string]int64),
+		Compressed: make(map[string]int64),
+		Rewritten:  true,
+	}
+	for _, c := range cols {
+		sb.Bytes[c] = m.Columns[c].Bytes
+		sb.Compressed[c] = m.Columns[c].Compressed
+	}
+	return
+}
+
+// call hook with each batch as it is sealed, in any shard. the rows
+// already in batches that are appended to are counted, so that the hook
+// is given the full number of rows. rows removed when replacing through
+// the url index are removed once the batches are sealed, when the shard
+// is closed, and each batch they are removed from is then given to the
+// hook again, marked as rewritten, with all of its rows and bytes
+func (s *Shard) OnSeal(hook SealHook) {
+	s.hook = hook
+}
@@ -2,7 +2,6 @@ package giashard
 
 import (
 	"fmt"
-	"hash/fnv"
 	"log"
 	"net/url"
 	"os"
@@ -21,6 +20,27 @@ type Shard struct {
 	key     string   // key to use for sharding
 	cols    []string // columns
 	batches []*Batch
+	cache   *SlugCache // optional cache of slugs and shard ids
+
+	manifest  *Manifest        // how the tree is sharded
+	hotsize   int64            // size beyond which to split a slug
+	hotk      uint             // number of shards to split it over
+	slugbytes map[string]int64 // running totals for finding hot slugs
+
+	dist    *Distribution // in a dry run, where rows would have gone
+	filter  *Filter       // rows must pass this to be kept
+	dedup   *Deduper      // drops rows whose text was seen before
+	summary Summary
+
+	indexes   []*URLIndex // per shard, opened as needed
+	indexmode IndexMode
+
+	transforms []Transform
+	capper     *Capper
+	overflow   *Shard // where rows over the cap go
+	blocklist  *Blocklist
+	hook       SealHook
+	rowindex   int64 // rows between row index entries, 0 for none
 }
 
 // we need a specific error type to distinguish from cases where we
@@ -68,14 +88,52 @@ func init() {
 
 // disperse records over 2^n shards using key, with batch sizes of size
 // this uses the idea of "domain" from publicsuffix, which tries to get the
-// most "significant" part of a domain name, stripping prefixes and suffixes
+// most "significant" part of a domain name, stripping prefixes and suffixes.
+// if dir already holds a sharded tree, its manifest must agree on n and key
 func NewShard(dir string, n uint, size int64, key string, cols ...string) (s *Shard, err error) {
-	batches := make([]*Batch, 1<<n)
-	s = &Shard{dir, n, size, key, cols, batches}
+	m, err := OpenManifest(dir, n, key)
+	if err != nil {
+		return
+	}
+
+	slots := 1 << n
+	if m.Buckets > 1 {
+		// later runs into a bucketed tree keep to its buckets
+		slots *= int(m.Buckets)
+	}
+	batches := make([]*Batch, slots)
+	s = &Shard{dir: dir, n: n, size: size, key: key, cols: cols, batches: batches, manifest: m}
+	if m.Indexed {
+		// keep the index up to date, even if not asked to use it
+		s.Index(IndexAppend)
+	}
 	return
 }
 
+// remember the shard ids of up to size hosts rather than computing them
+// afresh for every row. the cache is returned so that its statistics
+// can be inspected
+func (s *Shard) CacheSlugs(size int) *SlugCache {
+	s.cache = NewSlugCache(size, s.n)
+	return s.cache
+}
+
+// don't write anything, just record where each row would have gone in
+// the returned distribution
+func (s *Shard) DryRun() *Distribution {
+	s.dist = NewDistribution(s.n, s.manifest.Buckets, s.size)
+	return s.dist
+}
+
 func (s *Shard) Close() (err error) {
+	if s.dedup != nil {
+		if e := s.dedup.Close(); e != nil {
+			err = e
+		}
+	}
+	if s.dist != nil {
+		return
+	}
 	for _, b := range s.batches {
 		if b != nil {
 			e := b.Close()
@@ -84,19 +142,61 @@ func (s *Shard) Close() (err error) {
 			}
 		}
 	}
+	for i, idx := range s.indexes {
+		if idx != nil {
+			if e := idx.Close(s.cols, s.shardHook(uint64(i))); e != nil {
+				err = e
+			}
+		}
+	}
+	if e := s.manifest.Write(s.dir); e != nil {
+		err = e
+	}
 	return
 }
 
+// assign slugs using the given map, falling back to the hash for slugs
+// that aren't in it. the map is copied into the tree
+func (s *Shard) UseSlugMap(sm SlugMap) error {
+	return s.manifest.UseSlugMap(sm)
+}
+
+func (s *Shard) Manifest() *Manifest {
+	return s.manifest
+}
+
+// what has become of the rows written so far
+func (s *Shard) Summary() *Summary {
+	if s.filter != nil {
+		s.summary.Filters = make(map[string]int64)
+		for _, p := range s.filter.Predicates() {
+			s.summary.Filters[p.Expr] = p.Rejected
+		}
+	}
+	for _, t := range s.transforms {
+		switch t := t.(type) {
+		case *Normaliser:
+			s.summary.Normalise = t.Summary()
+		case *Redactor:
+			s.summary.Redacted = t.Counts()
+		}
+	}
+	return &s.summary
+}
+
 func AddRulesToDefaultList(domainList string) (added int, err error) {
 	rules, err := publicsuffix.DefaultList.LoadFile(domainList, nil)
 	return len(rules), err
 }
 
-// pull out second-level domain (SLD) to calculate shard bucket number
-func Slug(key string) (slug string, err error) {
+// pull the host name out of a url
+func Host(key string) (host string, err error) {
+	if host, ok := quickHost(key); ok {
+		return host, nil
+	}
+
 	// parse the url to get the domain name
 	url, e := url.Parse(key)
-	var host string
 	if e != nil || len(url.Host) == 0 {
 		// if we can't parse it, try to extract something sensible using a regexp
 		ms := host_re.FindStringSubmatch(key)
@@ -108,6 +208,15 @@ func Slug(key string) (slug string, err error) {
 	} else {
 		host = strings.TrimRight(url.Host, ".") // a trailing . will confuse publicsuffix
 	}
+	return
+}
+
+// pull out second-level domain (SLD) to calculate shard bucket number
+func Slug(key string) (slug string, err error) {
+	host, err := Host(key)
+	if err != nil {
+		return
+	}
 
 	// parse the domain name to get the slug
 	dn, err := publicsuffix.Parse(host)
@@ -126,20 +235,13 @@ func Slug(key string) (slug string, err error) {
 }
 
 func ShardId(key string, n uint) (shard uint64, err error) {
-	hash := fnv.New64() // calculate new 64-bit hash
-
 	slug, err := Slug(key)
 	if err != nil {
 		return
 	}
 
 	// use the slug to compute the hash
-	_, err = hash.Write([]byte(slug))
-	if err != nil {
-		return
-	}
-
-	shard = hash.Sum64() % (1 << n)
+	shard = slugShard(slug, n)
 	return
 }
 
@@ -149,37 +251,159 @@ func ShardId(key string, n uint) (shard uint64, err error) {
 // skip to the next row. If a different kind of error is returned, it
 // relates to writing the output and should be considered fatal.
 func (s *Shard) WriteRow(row map[string][]byte) (err error) {
-	key := row[s.key]
+	s.summary.Rows++
+	for _, t := range s.transforms {
+		var keep bool
+		if keep, err = t.Transform(row); err != nil {
+			return
+		}
+		if !keep {
+			s.summary.Dropped++
+			return
+		}
+	}
+	if s.blocklist != nil {
+		if _, blocked := s.blocklist.Match(string(row[s.key])); blocked {
+			s.summary.Blocked++
+			return
+		}
+	}
+	if s.filter != nil && !s.filter.Keep(row) {
+		s.summary.Filtered++
+		return
+	}
+	key := s.manifest.canonicalKey(string(row[s.key]))
 
-	shard, err := ShardId(string(key), s.n)
+	slug, shard, err := s.locate(key)
 	if err != nil {
+		s.summary.Failed++
+		if s.dist != nil {
+			s.dist.Fail()
+		}
+		return
+	}
+	if sp := s.manifest.Sample; sp != nil && !sp.Keep(slug, row) {
+		s.summary.Sampled++
 		return
 	}
+	if s.capper != nil && !s.capper.Keep(slug, key, row) {
+		return s.capRow(row)
+	}
+	s.detectHot(slug, row)
+	shard = s.manifest.assign(slug, shard, key)
+
+	if s.dedup != nil {
+		dup, err := s.dedup.Seen(shard, row)
+		if err != nil {
+			return err
+		}
+		if dup {
+			s.summary.Duplicates[shard]++
+			return nil
+		}
+	}
 
-	if s.batches[shard] == nil {
-		b, err := s.openShard(shard)
+	var idx *URLIndex
+	var hash uint64
+	if s.indexes != nil {
+		if idx, err = s.urlIndex(shard); err != nil {
+			return
+		}
+		hash = URLHash([]byte(key))
+		if skip := s.checkIndex(idx, hash); skip {
+			return
+		}
+	}
+
+	slot, bucket := shard, uint(0)
+	if k := s.manifest.Buckets; k > 1 {
+		bucket = s.manifest.Bucket(key)
+		slot = shard*uint64(k) + uint64(bucket)
+	}
+	if s.dist != nil {
+		s.dist.Add(shard, bucket, slug, row)
+		return
+	}
+	if s.batches[slot] == nil {
+		b, err := s.openShard(shard, bucket)
 		if err != nil {
 			return err
 		}
-		s.batches[shard] = b
+		s.batches[slot] = b
 	}
 
-	err = s.batches[shard].WriteRow(row)
+	if err = s.batches[slot].WriteRow(row); err != nil {
+		return
+	}
+	s.summary.Written++
+	if idx != nil {
+		batch, row := s.batches[slot].Last()
+		idx.Put(hash, batch, row)
+	}
+
+	return
+}
 
+// find the slug of key, and the shard the slug hashes to
+func (s *Shard) locate(key string) (slug string, shard uint64, err error) {
+	if s.cache != nil {
+		e, err := s.cache.lookup(key)
+		if err != nil {
+			return "", 0, err
+		}
+		return e.slug, e.shard, nil
+	}
+
+	slug, err = Slug(key)
+	if err != nil {
+		return
+	}
+	shard = slugShard(slug, s.n)
 	return
 }
 
-func (s *Shard) openShard(shard uint64) (b *Batch, err error) {
+func (s *Shard) openShard(shard uint64, bucket uint) (b *Batch, err error) {
 	sdir := s.shardDir(shard)
 	log.Printf("Initialising shard %d at %s", shard, sdir)
 	if err = os.MkdirAll(sdir, os.ModePerm); err != nil {
 		return
 	}
+	// mark the root of the tree from the start, as finding the tree's
+	// dictionaries depends on it, see dict.go. Close writes it again
+	if _, e := os.Stat(filepath.Join(s.dir, ManifestName)); os.IsNotExist(e) {
+		if err = s.manifest.Write(s.dir); err != nil {
+			return
+		}
+	}
 
-	b, err = NewBatch(sdir, s.size, s.cols...)
+	if k := s.manifest.Buckets; k > 1 {
+		b, err = NewBucketBatch(sdir, s.size, bucket, k, s.cols...)
+	} else {
+		b, err = NewBatch(sdir, s.size, s.cols...)
+	}
+	if err == nil && (s.indexes != nil || s.hook != nil) {
+		err = b.CountRows()
+	}
+	if err == nil && s.rowindex > 0 {
+		err = b.IndexRows(s.rowindex)
+	}
+	if err == nil && s.hook != nil {
+		b.OnSeal(s.shardHook(shard))
+	}
 	return
 }
 
+// the hook for batches of the given shard, if there is one
+func (s *Shard) shardHook(shard uint64) SealHook {
+	if s.hook == nil {
+		return nil
+	}
+	return func(sb *SealedBatch) error {
+		sb.Shard = shard
+		return s.hook(sb)
+	}
+}
+
 func (s *Shard) shardDir(n uint64) string {
 	return filepath.Join(s.dir, strconv.FormatInt(int64(n), 10))
 }
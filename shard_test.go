@@ -2,6 +2,11 @@ package giashard
 
 import (
 	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -59,3 +64,393 @@ func TestError(t *testing.T) {
 		t.Errorf("ShardErr mistakenly identified as generic error")
 	}
 }
+
+func TestSlugCache(t *testing.T) {
+	keys := []string{
+		"http://localhost/ford_a/ford_a_restore_2013_02.html",
+		"http://www.example.com:8080/index.html",
+		"svn+ssh://example.org/repo",
+		"http://-foo.example.org/",
+		"https://a/",
+		"https://www.example.com/",
+		"https://news.example.co.uk/a?b#c",
+		"http://example.net./",
+	}
+	for _, tcase := range testcases {
+		keys = append(keys, tcase.url)
+	}
+
+	c := NewSlugCache(4, 8)
+	for pass := 0; pass < 2; pass++ {
+		for _, key := range keys {
+			expslug, experr := Slug(key)
+			slug, err := c.Slug(key)
+			if (err != nil) != (experr != nil) || slug != expslug {
+				t.Errorf("SlugCache.Slug(%v): got %v (%v) expected %v (%v)", key, slug, err, expslug, experr)
+			}
+			expshard, experr := ShardId(key, 8)
+			shard, err := c.ShardId(key)
+			if (err != nil) != (experr != nil) || shard != expshard {
+				t.Errorf("SlugCache.ShardId(%v): got %d (%v) expected %d (%v)", key, shard, err, expshard, experr)
+			}
+		}
+	}
+
+	stats := c.Stats()
+	if stats.Size > 4 {
+		t.Errorf("SlugCache grew to %d entries, expected at most 4", stats.Size)
+	}
+	if stats.Hits == 0 || stats.Evictions == 0 {
+		t.Errorf("SlugCache: unexpected statistics %v", stats)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	m := NewManifest(8, "url")
+	m.Split("reddit", 4)
+	m.Split("reddit", 2) // never shrinks
+
+	ids, err := m.ShardIds("http://www.reddit.com/")
+	if err != nil {
+		t.Fatalf("ShardIds: error: %v", err)
+	}
+	if len(ids) != 4 || ids[0] != 249 {
+		t.Errorf("ShardIds: got %v expected 4 shards from 249", ids)
+	}
+
+	seen := make(map[uint64]bool)
+	for _, page := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		shard, err := m.ShardId("http://www.reddit.com/r/" + page)
+		if err != nil {
+			t.Fatalf("ShardId: error: %v", err)
+		}
+		seen[shard] = true
+	}
+	for shard := range seen {
+		if shard < 249 || shard > 252 {
+			t.Errorf("ShardId: shard %d outside of split %v", shard, ids)
+		}
+	}
+	if len(seen) < 2 {
+		t.Errorf("ShardId: split slug only went to %v", seen)
+	}
+}
+
+func TestPackSlugs(t *testing.T) {
+	sizes := SlugSizes{"a": 50, "b": 40, "c": 30, "d": 20, "e": 10, "f": 10}
+	sm := PackSlugs(sizes, 1)
+
+	loads := make([]int64, 2)
+	for slug, shard := range sm {
+		loads[shard] += sizes[slug]
+	}
+	if loads[0] != 80 || loads[1] != 80 {
+		t.Errorf("PackSlugs: unbalanced shards %v from %v", loads, sm)
+	}
+	if err := sm.Validate(1); err != nil {
+		t.Errorf("PackSlugs: %v", err)
+	}
+	if !sm.Equal(PackSlugs(sizes, 1)) {
+		t.Errorf("PackSlugs: not deterministic")
+	}
+}
+
+func TestSkew(t *testing.T) {
+	for _, tcase := range []struct {
+		sizes   []int64
+		maxmean float64
+		gini    float64
+	}{
+		{[]int64{0, 0, 0, 0}, 0, 0},
+		{[]int64{5, 5, 5, 5}, 1, 0},
+		{[]int64{0, 10, 0, 0}, 4, 0.75},
+		{[]int64{3, 1}, 1.5, 0.25},
+	} {
+		maxmean, gini := skew(tcase.sizes)
+		if math.Abs(maxmean-tcase.maxmean) > 1e-9 || math.Abs(gini-tcase.gini) > 1e-9 {
+			t.Errorf("skew(%v): got %v, %v expected %v, %v", tcase.sizes, maxmean, gini, tcase.maxmean, tcase.gini)
+		}
+	}
+}
+
+func TestDistribution(t *testing.T) {
+	type add struct {
+		shard  uint64
+		bucket uint
+		slug   string
+		size   int
+	}
+	for _, tcase := range []struct {
+		name    string
+		k       uint // buckets
+		adds    []add
+		batches []int
+		bytes   []int64
+		top     string // largest slug of each shard
+	}{
+		{"one batch", 0, []add{{0, 0, "a", 4}, {0, 0, "a", 4}}, []int{1, 0}, []int64{8, 0}, "a:8 "},
+		{"rotated", 0, []add{{0, 0, "a", 6}, {0, 0, "b", 6}, {0, 0, "a", 6}}, []int{3, 0}, []int64{18, 0}, "a:12 "},
+		{"oversized row", 0, []add{{1, 0, "a", 20}, {1, 0, "b", 1}}, []int{0, 2}, []int64{0, 21}, " a:20"},
+		{"both shards", 0, []add{{0, 0, "a", 5}, {1, 0, "b", 3}, {1, 0, "c", 4}}, []int{1, 1}, []int64{5, 7}, "a:5 c:4"},
+		{"buckets", 3, []add{{0, 0, "a", 6}, {0, 1, "a", 6}, {0, 2, "b", 6}, {0, 0, "a", 6}}, []int{4, 0}, []int64{24, 0}, "a:18 "},
+		{"a batch per bucket", 2, []add{{1, 0, "a", 4}, {1, 1, "a", 4}}, []int{0, 2}, []int64{0, 8}, " a:8"},
+	} {
+		d := NewDistribution(1, tcase.k, 10)
+		for _, a := range tcase.adds {
+			d.Add(a.shard, a.bucket, a.slug, map[string][]byte{"text": make([]byte, a.size)})
+		}
+		d.Fail()
+		r := d.Report(1)
+		var top []string
+		for i, sd := range r.Shards {
+			if sd.Batches != tcase.batches[i] || sd.Bytes != tcase.bytes[i] {
+				t.Errorf("%v: shard %d: got %d batches, %d bytes expected %d, %d", tcase.name, i, sd.Batches, sd.Bytes, tcase.batches[i], tcase.bytes[i])
+			}
+			s := ""
+			for _, sc := range sd.TopSlugs {
+				s = fmt.Sprintf("%s:%d", sc.Slug, sc.Bytes)
+			}
+			top = append(top, s)
+		}
+		if strings.Join(top, " ") != tcase.top {
+			t.Errorf("%v: got top slugs %q expected %q", tcase.name, strings.Join(top, " "), tcase.top)
+		}
+		if r.Rows != int64(len(tcase.adds)) || r.Failed != 1 || r.Bytes != tcase.bytes[0]+tcase.bytes[1] {
+			t.Errorf("%v: unexpected totals %+v", tcase.name, r)
+		}
+	}
+}
+
+func TestPins(t *testing.T) {
+	m := NewManifest(8, "url")
+	m.Split("reddit", 4)
+	pins := []struct {
+		pattern string
+		shard   uint64
+	}{
+		{"reddit", 7},
+		{"*.example.co.uk", 3},
+	}
+	for _, p := range pins {
+		pin, err := NewPin(p.pattern, p.shard)
+		if err != nil {
+			t.Fatalf("NewPin(%v): error: %v", p.pattern, err)
+		}
+		if err = m.Pin(pin); err != nil {
+			t.Fatalf("Pin(%v): error: %v", p.pattern, err)
+		}
+	}
+
+	var pincases = [...]struct {
+		url   string
+		shard uint64
+	}{
+		{"http://www.reddit.com/r/a", 7},
+		{"http://news.example.co.uk/", 3},
+		{"http://www.example.com/", 61},
+	}
+	for _, tcase := range pincases {
+		shard, err := m.ShardId(tcase.url)
+		if err != nil {
+			t.Errorf("ShardId(%v): error: %v", tcase.url, err)
+		} else if shard != tcase.shard {
+			t.Errorf("ShardId(%v): got %d expected %d", tcase.url, shard, tcase.shard)
+		}
+	}
+
+	bad, _ := NewPin("toobig", 256)
+	if err := m.Pin(bad); err == nil {
+		t.Errorf("Pin: shard 256 of 256 accepted")
+	}
+	moved, _ := NewPin("reddit", 8)
+	if err := m.Pin(moved); err == nil {
+		t.Errorf("Pin: moving a pinned slug accepted")
+	}
+}
+
+func TestSampler(t *testing.T) {
+	byurl, err := NewSampler("url", 0.1, 42)
+	if err != nil {
+		t.Fatalf("NewSampler: error: %v", err)
+	}
+	byslug, _ := NewSampler("slug", 0.5, 42)
+
+	kept := 0
+	slugs := make(map[bool]int)
+	for i := 0; i < 10000; i++ {
+		row := map[string][]byte{"url": []byte(fmt.Sprintf("http://www.reddit.com/r/%d", i))}
+		if byurl.Keep("reddit", row) {
+			kept++
+		}
+		slugs[byslug.Keep("reddit", row)]++
+	}
+	if kept < 900 || kept > 1100 {
+		t.Errorf("Sampler: kept %d of 10000 rows at 0.1", kept)
+	}
+	if len(slugs) != 1 {
+		t.Errorf("Sampler: sampling by slug split a domain %v", slugs)
+	}
+
+	if _, err := NewSampler("url", 1.5, 0); err == nil {
+		t.Errorf("NewSampler: fraction 1.5 accepted")
+	}
+}
+
+func TestSealHook(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewShard(dir, 1, 100, "url", "url", "text")
+	if err != nil {
+		t.Fatalf("NewShard: error: %v", err)
+	}
+	var sealed []*SealedBatch
+	s.OnSeal(func(sb *SealedBatch) error {
+		sealed = append(sealed, sb)
+		return nil
+	})
+
+	for i := 0; i < 10; i++ {
+		row := map[string][]byte{"url": []byte(fmt.Sprintf("http://example.com/%d", i)), "text": []byte("text")}
+		if err = s.WriteRow(row); err != nil {
+			t.Fatalf("WriteRow: error: %v", err)
+		}
+	}
+	// rows of 20 bytes, so five to a batch
+	if len(sealed) != 1 {
+		t.Errorf("expected 1 batch sealed on rotation, got %d", len(sealed))
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close: error: %v", err)
+	}
+	if len(sealed) != 2 {
+		t.Fatalf("expected 2 batches sealed in all, got %d", len(sealed))
+	}
+	rows := int64(0)
+	for i, sb := range sealed {
+		if sb.Batch != i+1 || sb.Compressed["url"] == 0 {
+			t.Errorf("unexpected sealed batch %+v", sb)
+		}
+		rows += sb.Rows
+	}
+	if rows != 10 || sealed[0].Bytes["text"] != 5*5 {
+		t.Errorf("expected 10 rows, 25 bytes of text in the first batch, got %d and %d", rows, sealed[0].Bytes["text"])
+	}
+
+	// and each has metadata to check it against
+	m, err := ReadBatchMeta(sealed[0].Path)
+	if err != nil {
+		t.Fatalf("ReadBatchMeta: error: %v", err)
+	}
+	if m.Rows != 5 || m.Columns["text"].Bytes != 25 {
+		t.Errorf("expected metadata for 5 rows and 25 bytes of text, got %+v", m)
+	}
+	if err = VerifyBatch(sealed[0].Path); err != nil {
+		t.Errorf("VerifyBatch: error: %v", err)
+	}
+	w, err := NewLineWriter(filepath.Join(sealed[0].Path, "text.gz"))
+	if err != nil {
+		t.Fatalf("NewLineWriter: error: %v", err)
+	}
+	w.WriteLine([]byte("more"))
+	w.Close()
+	if err = VerifyBatch(sealed[0].Path); err == nil {
+		t.Errorf("VerifyBatch: expected an error for an extra row")
+	}
+
+	// metadata of a batch appended to, from what was written, is the same
+	// as from reading it
+	if s, err = NewShard(dir, 1, 1000, "url", "url", "text"); err != nil {
+		t.Fatalf("NewShard: error: %v", err)
+	}
+	if err = s.WriteRow(map[string][]byte{"url": []byte("http://example.com/more"), "text": []byte("more")}); err != nil {
+		t.Fatalf("WriteRow: error: %v", err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close: error: %v", err)
+	}
+	m, err = ReadBatchMeta(sealed[1].Path)
+	if err != nil {
+		t.Fatalf("ReadBatchMeta: error: %v", err)
+	}
+	read, err := NewBatchMeta(sealed[1].Path, []string{"text", "url"}, nil)
+	if err != nil {
+		t.Fatalf("NewBatchMeta: error: %v", err)
+	}
+	if m.Rows != 6 || fmt.Sprint(m.Columns) != fmt.Sprint(read.Columns) {
+		t.Errorf("expected metadata for 6 rows as read, %+v, got %+v", read.Columns, m)
+	}
+	if err = VerifyBatch(sealed[1].Path); err != nil {
+		t.Errorf("VerifyBatch: error: %v", err)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewShard(dir, 1, 100, "url", "url")
+	if err != nil {
+		t.Fatalf("NewShard: error: %v", err)
+	}
+	if err = s.Buckets(3); err != nil {
+		t.Fatalf("Buckets: error: %v", err)
+	}
+	for i := 0; i < 60; i++ {
+		row := map[string][]byte{"url": []byte(fmt.Sprintf("http://example.com/%d", i))}
+		if err = s.WriteRow(row); err != nil {
+			t.Fatalf("WriteRow: error: %v", err)
+		}
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close: error: %v", err)
+	}
+
+	m, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatalf("ReadManifest: error: %v", err)
+	}
+	if err = m.SetBuckets(4); err == nil {
+		t.Errorf("SetBuckets: expected an error changing the number of buckets")
+	}
+	shard, _ := m.ShardId("http://example.com/")
+	batches, err := Batches(filepath.Join(dir, fmt.Sprint(shard)))
+	if err != nil {
+		t.Fatalf("Batches: error: %v", err)
+	}
+	if len(batches) <= 3 {
+		t.Errorf("expected batches to rotate within buckets, got %d batches", len(batches))
+	}
+	rows := 0
+	for _, batch := range batches {
+		number, _ := strconv.Atoi(filepath.Base(batch))
+		r, err := NewColumnReader(batch, "url")
+		if err != nil {
+			t.Fatalf("NewColumnReader: error: %v", err)
+		}
+		for row := range r.Rows() {
+			if b := m.Bucket(string(row["url"])); b != BatchBucket(number, 3) {
+				t.Errorf("%s in batch %d of bucket %d, expected bucket %d", row["url"], number, BatchBucket(number, 3), b)
+			}
+			rows++
+		}
+		r.Close()
+	}
+	if rows != 60 {
+		t.Errorf("expected 60 rows, got %d", rows)
+	}
+
+	// a tree with batches but no buckets can't be given them
+	dir = t.TempDir()
+	if s, err = NewShard(dir, 1, 100, "url", "url"); err != nil {
+		t.Fatalf("NewShard: error: %v", err)
+	}
+	if err = s.WriteRow(map[string][]byte{"url": []byte("http://example.com/")}); err != nil {
+		t.Fatalf("WriteRow: error: %v", err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close: error: %v", err)
+	}
+	if s, err = NewShard(dir, 1, 100, "url", "url"); err != nil {
+		t.Fatalf("NewShard: error: %v", err)
+	}
+	if err = s.Buckets(3); err == nil {
+		t.Errorf("Buckets: expected an error for a tree with batches without buckets")
+	}
+}
@@ -0,0 +1,198 @@
+package giashard
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/weppos/publicsuffix-go/publicsuffix"
+)
+
+// A SlugCache remembers the slug and shard id computed for a host, so
+// that the url parsing, public suffix lookup and hashing only have to be
+// done once per host rather than once per row. Crawls are heavily
+// clustered by host, so this saves most of the work in Shard.WriteRow.
+//
+// The cache holds at most size hosts, evicting the least recently used
+// one when it is full, and is safe for concurrent use.
+type SlugCache struct {
+	mu      sync.Mutex
+	n       uint // number of shards (2^n)
+	size    int  // maximum number of entries
+	entries map[string]*list.Element
+	lru     *list.List
+	stats   CacheStats
+}
+
+type slugEntry struct {
+	host  string
+	slug  string
+	shard uint64
+}
+
+// hit rate statistics for a SlugCache
+type CacheStats struct {
+	Size      int    `json:"size"`
+	Capacity  int    `json:"capacity"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Bypassed  uint64 `json:"bypassed"` // keys we could not cache
+	Evictions uint64 `json:"evictions"`
+}
+
+func (cs CacheStats) HitRate() float64 {
+	total := cs.Hits + cs.Misses + cs.Bypassed
+	if total == 0 {
+		return 0
+	}
+	return float64(cs.Hits) / float64(total)
+}
+
+func (cs CacheStats) String() string {
+	return fmt.Sprintf("%d/%d entries, %d hits, %d misses, %d bypassed, %d evictions, hit rate %.2f%%",
+		cs.Size, cs.Capacity, cs.Hits, cs.Misses, cs.Bypassed, cs.Evictions, 100*cs.HitRate())
+}
+
+func NewSlugCache(size int, n uint) *SlugCache {
+	if size < 1 {
+		size = 1
+	}
+	return &SlugCache{
+		n:       n,
+		size:    size,
+		entries: make(map[string]*list.Element, size),
+		lru:     list.New(),
+		stats:   CacheStats{Capacity: size},
+	}
+}
+
+// cheaply pull the host out of an absolute url of the form
+// scheme://host/... without going through url.Parse. this only succeeds
+// for the plain hostnames where both url.Parse and host_re, as used by
+// Slug, would arrive at exactly the same answer; anything unusual (ports,
+// user info, escapes, no scheme) is left to Slug.
+func quickHost(key string) (host string, ok bool) {
+	i := 0
+	for i < len(key) && isAlpha(key[i]) {
+		i++
+	}
+	if i == 0 || len(key) < i+3 || key[i:i+3] != "://" {
+		return
+	}
+	start := i + 3
+	end := start
+	for end < len(key) && (isAlnum(key[end]) || key[end] == '-' || key[end] == '.') {
+		end++
+	}
+	if end < len(key) && key[end] != '/' && key[end] != '?' && key[end] != '#' {
+		return
+	}
+	for end > start && key[end-1] == '.' {
+		end--
+	}
+	if end-start < 2 || !isAlnum(key[start]) || !isAlnum(key[end-1]) {
+		return
+	}
+	return key[start:end], true
+}
+
+func isAlpha(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isAlnum(c byte) bool {
+	return isAlpha(c) || ('0' <= c && c <= '9')
+}
+
+// the shard for a slug, as used by ShardId
+func slugShard(slug string, n uint) uint64 {
+	hash := fnv.New64()
+	hash.Write([]byte(slug)) // never returns an error
+	return hash.Sum64() % (1 << n)
+}
+
+func (c *SlugCache) lookup(key string) (e *slugEntry, err error) {
+	host, ok := quickHost(key)
+	if !ok {
+		c.count(&c.stats.Bypassed)
+		return c.compute(key)
+	}
+
+	c.mu.Lock()
+	if el, ok := c.entries[host]; ok {
+		c.lru.MoveToFront(el)
+		c.stats.Hits++
+		e = el.Value.(*slugEntry)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+
+	// only the public suffix part of Slug depends on nothing but the
+	// host. if that fails, Slug falls back to looking at the whole key,
+	// which we can't cache by host
+	dn, perr := publicsuffix.Parse(host)
+	if perr != nil {
+		c.count(&c.stats.Bypassed)
+		return c.compute(key)
+	}
+	e = &slugEntry{host, dn.SLD, slugShard(dn.SLD, c.n)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Misses++
+	if el, ok := c.entries[host]; ok {
+		// somebody else got here first
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[host] = c.lru.PushFront(e)
+	if c.lru.Len() > c.size {
+		old := c.lru.Remove(c.lru.Back()).(*slugEntry)
+		delete(c.entries, old.host)
+		c.stats.Evictions++
+	}
+	return
+}
+
+func (c *SlugCache) compute(key string) (e *slugEntry, err error) {
+	slug, err := Slug(key)
+	if err != nil {
+		return
+	}
+	e = &slugEntry{"", slug, slugShard(slug, c.n)}
+	return
+}
+
+func (c *SlugCache) count(n *uint64) {
+	c.mu.Lock()
+	*n++
+	c.mu.Unlock()
+}
+
+// as the package level Slug, but cached
+func (c *SlugCache) Slug(key string) (slug string, err error) {
+	e, err := c.lookup(key)
+	if err != nil {
+		return
+	}
+	return e.slug, nil
+}
+
+// as the package level ShardId, but cached
+func (c *SlugCache) ShardId(key string) (shard uint64, err error) {
+	e, err := c.lookup(key)
+	if err != nil {
+		return
+	}
+	return e.shard, nil
+}
+
+func (c *SlugCache) Stats() (stats CacheStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats = c.stats
+	stats.Size = c.lru.Len()
+	return
+}
@@ -0,0 +1,154 @@
+package giashard
+
+/*
+Hashing slugs onto shards gives shards whose sizes vary a lot when a few
+domains dominate a crawl. Given the total size of each slug, from a first
+pass over the input, the slugs can instead be packed onto shards so that
+their sizes come out roughly even. The assignment is kept as a slug map, a
+text file with one tab separated slug and shard id per line. Slugs that
+are not in the map fall back to the hash.
+*/
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type SlugMap map[string]uint64
+
+// running totals of bytes per slug, as the first pass of planning a
+// slug map
+type SlugSizes map[string]int64
+
+// count the row towards the size of the slug
+func (ss SlugSizes) Add(slug string, row map[string][]byte) {
+	ss[slug] += RowSize(row)
+}
+
+func ReadSlugMap(filename string) (sm SlugMap, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	sm = make(SlugMap)
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v:%d: expected slug and shard separated by a tab", filename, lineno)
+		}
+		shard, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: %w", filename, lineno, err)
+		}
+		sm[fields[0]] = shard
+	}
+	err = scanner.Err()
+	return
+}
+
+// write the map out sorted by slug, so that it diffs nicely
+func (sm SlugMap) Write(filename string) (err error) {
+	slugs := make([]string, 0, len(sm))
+	for slug := range sm {
+		slugs = append(slugs, slug)
+	}
+	sort.Strings(slugs)
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(file)
+	for _, slug := range slugs {
+		if _, err = fmt.Fprintf(w, "%s\t%d\n", slug, sm[slug]); err != nil {
+			file.Close()
+			return
+		}
+	}
+	if err = w.Flush(); err != nil {
+		file.Close()
+		return
+	}
+	return file.Close()
+}
+
+// check that every shard id in the map exists among 2^n shards
+func (sm SlugMap) Validate(n uint) (err error) {
+	for slug, shard := range sm {
+		if shard >= 1<<n {
+			return fmt.Errorf("slug %v is mapped to shard %d, but there are only %d shards", slug, shard, 1<<n)
+		}
+	}
+	return
+}
+
+func (sm SlugMap) Equal(other SlugMap) bool {
+	if len(sm) != len(other) {
+		return false
+	}
+	for slug, shard := range sm {
+		if o, ok := other[slug]; !ok || o != shard {
+			return false
+		}
+	}
+	return true
+}
+
+// a min-heap of shards by the number of bytes assigned to them so far
+type binHeap struct {
+	shards []uint64
+	loads  []int64
+}
+
+func (h *binHeap) Len() int { return len(h.shards) }
+func (h *binHeap) Less(i, j int) bool {
+	li, lj := h.loads[h.shards[i]], h.loads[h.shards[j]]
+	return li < lj || (li == lj && h.shards[i] < h.shards[j])
+}
+func (h *binHeap) Swap(i, j int)      { h.shards[i], h.shards[j] = h.shards[j], h.shards[i] }
+func (h *binHeap) Push(x interface{}) { h.shards = append(h.shards, x.(uint64)) }
+func (h *binHeap) Pop() interface{} {
+	x := h.shards[len(h.shards)-1]
+	h.shards = h.shards[:len(h.shards)-1]
+	return x
+}
+
+// assign slugs to 2^n shards so as to even out the total size of each
+// shard, by placing the slugs from largest to smallest each onto the
+// least loaded shard. ties are broken by slug and shard id so that the
+// same sizes always give the same map.
+func PackSlugs(sizes SlugSizes, n uint) (sm SlugMap) {
+	slugs := make([]string, 0, len(sizes))
+	for slug := range sizes {
+		slugs = append(slugs, slug)
+	}
+	sort.Slice(slugs, func(i, j int) bool {
+		si, sj := sizes[slugs[i]], sizes[slugs[j]]
+		return si > sj || (si == sj && slugs[i] < slugs[j])
+	})
+
+	h := &binHeap{make([]uint64, 1<<n), make([]int64, 1<<n)}
+	for i := range h.shards {
+		h.shards[i] = uint64(i)
+	}
+	heap.Init(h)
+
+	sm = make(SlugMap, len(slugs))
+	for _, slug := range slugs {
+		shard := h.shards[0]
+		sm[slug] = shard
+		h.loads[shard] += sizes[slug]
+		heap.Fix(h, 0)
+	}
+	return
+}
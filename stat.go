@@ -10,6 +10,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
 type LangStats struct {
@@ -26,11 +28,14 @@ type ShardStats struct {
 	English LangStats        `json:"english"`
 }
 
-func (s *ShardStats) openfile(fname string) (ch chan []byte, err error) {
+// call fn with each line of the file, counting them. the line is only
+// good until fn returns
+func (s *ShardStats) eachLine(fname string, fn func(doc []byte)) {
 	s.Bytes[fname] = -1
 	s.Records[fname] = -1
 
-	fullpath := filepath.Join(s.Shard, fname)
+	// named as the gzip file, even if the column is compressed with zstd
+	fullpath := ColumnFile(s.Shard, strings.TrimSuffix(fname, ".gz"))
 	stat, err := os.Stat(fullpath)
 	if err != nil {
 		log.Printf("error reading %v", fullpath)
@@ -42,20 +47,15 @@ func (s *ShardStats) openfile(fname string) (ch chan []byte, err error) {
 	if err != nil {
 		return
 	}
+	defer r.Close()
 
-	r.Fatal(false)
-
-	ch = make(chan []byte)
-	go func() {
-		for doc := range r.Lines() {
-			s.Records[fname] += 1
-			ch <- doc
-		}
-		close(ch)
-		r.Close()
-	}()
-
-	return
+	for r.Next() {
+		s.Records[fname] += 1
+		fn(r.Line())
+	}
+	if err = r.Err(); err != nil {
+		log.Printf("error reading column: %v", err)
+	}
 }
 
 func getLines(doc []byte) (lines [][]byte, err error) {
@@ -147,62 +147,62 @@ func ReadStats(shard string) (stats *ShardStats, err error) {
 	return
 }
 
-func (s *ShardStats) Calc() {
-	lines, err := s.openfile("mime.gz")
-	if err == nil {
-		for range lines {
-			//
-		}
-	}
-
-	lines, err = s.openfile("source.gz")
-	if err == nil {
-		for range lines {
-			//
-		}
-	}
-
-	lines, err = s.openfile("url.gz")
-	if err == nil {
-		for range lines {
-			//
-		}
+// the file sizes and record counts from the batch's metadata, leaving
+// out the statistics that need the text to be read
+func StatsFromMeta(shard string) (stats *ShardStats, err error) {
+	m, err := ReadBatchMeta(shard)
+	if err != nil {
+		return
 	}
-
-	docs, err := s.openfile("plain_text.gz")
-	if err == nil {
-		for range docs {
-			//
-		}
+	stats = NewStats(shard)
+	for c, cm := range m.Columns {
+		stats.Bytes[c+".gz"] = cm.Compressed
+		stats.Records[c+".gz"] = int(cm.Rows)
 	}
+	return
+}
 
-	docs, err = s.openfile("sentences.gz")
-	if err == nil {
-		for doc := range docs {
-			s.Native.countLines("sentences.gz", doc)
-		}
-	}
+func (s *ShardStats) Calc() {
+	count := func(doc []byte) {}
+	s.eachLine("mime.gz", count)
+	s.eachLine("source.gz", count)
+	s.eachLine("url.gz", count)
+	s.eachLine("plain_text.gz", count)
+
+	s.eachLine("sentences.gz", func(doc []byte) {
+		s.Native.countLines("sentences.gz", doc)
+	})
+	s.eachLine("tokenised.gz", func(doc []byte) {
+		s.Native.countTokens("tokenised.gz", doc)
+	})
+	s.eachLine("sentences_en.gz", func(doc []byte) {
+		s.English.countLines("sentences_en.gz", doc)
+	})
+	s.eachLine("tokenised_en.gz", func(doc []byte) {
+		s.English.countTokens("tokenised_en.gz", doc)
+	})
+}
 
-	docs, err = s.openfile("tokenised.gz")
-	if err == nil {
-		for doc := range docs {
-			s.Native.countTokens("tokenised.gz", doc)
+// check that the columns the statistics cover all have the same number
+// of records
+func (s *ShardStats) Aligned() error {
+	var cols []string
+	for fname := range s.Records {
+		if s.Bytes[fname] >= 0 {
+			cols = append(cols, fname)
 		}
 	}
-
-	docs, err = s.openfile("sentences_en.gz")
-	if err == nil {
-		for doc := range docs {
-			s.English.countLines("sentences_en.gz", doc)
-		}
+	sort.Strings(cols)
+	rows := make([]int64, len(cols))
+	for i, fname := range cols {
+		rows[i] = int64(s.Records[fname])
 	}
-
-	docs, err = s.openfile("tokenised_en.gz")
-	if err == nil {
-		for doc := range docs {
-			s.English.countTokens("tokenised_en.gz", doc)
+	for _, n := range rows {
+		if n != rows[0] {
+			return &AlignErr{s.Shard, cols, rows}
 		}
 	}
+	return nil
 }
 
 func (s *ShardStats) Marshal() (buf []byte, err error) {
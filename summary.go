@@ -0,0 +1,80 @@
+package giashard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// counts of what became of the rows given to a Shard during a run
+type Summary struct {
+	Rows     int64            `json:"rows"`               // rows given to WriteRow
+	Written  int64            `json:"written"`            // rows written out
+	Dropped  int64            `json:"dropped,omitempty"`  // rows dropped by a transform
+	Blocked  int64            `json:"blocked,omitempty"`  // rows on the blocklist
+	Failed   int64            `json:"failed"`             // rows for which no slug could be found
+	Sampled  int64            `json:"sampled,omitempty"`  // rows left out of the sample
+	Filtered int64            `json:"filtered,omitempty"` // rows rejected by the filter
+	Filters  map[string]int64 `json:"filters,omitempty"`  // rows rejected by each predicate
+	Capped   int64            `json:"capped,omitempty"`   // rows over the cap for their slug
+
+	// rows over the maximum record size, which are not counted in Rows
+	// unless they were truncated
+	Oversized int64 `json:"oversized,omitempty"`
+
+	Duplicates map[uint64]int64  `json:"duplicates,omitempty"` // duplicate rows dropped in each shard
+	Index      *IndexSummary     `json:"index,omitempty"`
+	Normalise  *NormaliseSummary `json:"normalise,omitempty"`
+	Redacted   map[string]int64  `json:"redacted,omitempty"` // matches of each redaction rule
+}
+
+// what happened to rows checked against the url index
+type IndexSummary struct {
+	Mode     string `json:"mode"`
+	New      int64  `json:"new"`      // rows whose url was not in the shard
+	Existing int64  `json:"existing"` // rows whose url was already in the shard
+	Skipped  int64  `json:"skipped"`  // existing rows left out
+	Replaced int64  `json:"replaced"` // existing rows whose old version was removed
+}
+
+func (sum *Summary) String() string {
+	dups := int64(0)
+	for _, n := range sum.Duplicates {
+		dups += n
+	}
+	str := fmt.Sprintf("%d rows, %d written, %d dropped, %d blocked, %d without slug, %d left out of sample, %d filtered, %d capped, %d duplicates",
+		sum.Rows, sum.Written, sum.Dropped, sum.Blocked, sum.Failed, sum.Sampled, sum.Filtered, sum.Capped, dups)
+	if sum.Oversized > 0 {
+		str += fmt.Sprintf(", %d oversized", sum.Oversized)
+	}
+	if idx := sum.Index; idx != nil {
+		str += fmt.Sprintf(", index (%s): %d new, %d existing, %d skipped, %d replaced",
+			idx.Mode, idx.New, idx.Existing, idx.Skipped, idx.Replaced)
+	}
+	if n := sum.Normalise; n != nil {
+		str += fmt.Sprintf(", normalisation: %d not base64, %d repaired, %d replaced, %d dropped, %d with control characters, %d normalised",
+			n.NotBase64, n.Repaired, n.Replaced, n.Dropped, n.Controls, n.Normalised)
+	}
+	if len(sum.Redacted) > 0 {
+		names := make([]string, 0, len(sum.Redacted))
+		for name := range sum.Redacted {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for i, name := range names {
+			names[i] = fmt.Sprintf("%d %s", sum.Redacted[name], name)
+		}
+		str += ", redacted: " + strings.Join(names, ", ")
+	}
+	return str
+}
+
+func (sum *Summary) Write(filename string) (err error) {
+	buf, err := json.MarshalIndent(sum, "", "  ")
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(filename, append(buf, '\n'), 0666)
+}
@@ -0,0 +1,342 @@
+package giashard
+
+/*
+A URL index records, for every row in a shard, a 64-bit hash of its key
+and the batch and row number it is in. It is kept next to the batches as
+urls.idx.gz: a gzip compressed list of entries sorted by hash, with the
+hashes delta encoded, all as varints.
+
+With an index, a new crawl can be added to an existing tree either
+skipping urls that are already there, replacing their old rows, or just
+appending everything.
+*/
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const URLIndexName = "urls.idx.gz"
+
+type IndexMode int
+
+const (
+	IndexAppend  IndexMode = iota // write everything
+	IndexSkip                     // leave out rows whose url is already in the shard
+	IndexReplace                  // write rows and remove older rows with the same url
+)
+
+var indexModes = map[string]IndexMode{"append": IndexAppend, "skip": IndexSkip, "replace": IndexReplace}
+
+func ParseIndexMode(mode string) (m IndexMode, err error) {
+	m, ok := indexModes[mode]
+	if !ok {
+		err = fmt.Errorf("unknown index mode %v, expected append, skip or replace", mode)
+	}
+	return
+}
+
+func (m IndexMode) String() string {
+	for name, mode := range indexModes {
+		if mode == m {
+			return name
+		}
+	}
+	return strconv.Itoa(int(m))
+}
+
+type urlLoc struct {
+	batch uint32
+	row   uint32
+}
+
+type urlEntry struct {
+	hash uint64
+	urlLoc
+}
+
+type URLIndex struct {
+	dir     string
+	entries []urlEntry // sorted, as read from disk
+	added   map[uint64]urlLoc
+	removed map[uint32][]uint32 // rows to remove from each batch
+}
+
+func URLHash(key []byte) uint64 {
+	hash := fnv.New64a()
+	hash.Write(key)
+	return mix64(hash.Sum64())
+}
+
+// read the index of the shard at dir. if there isn't one but the shard
+// has batches, the index is built from their key column, canonicalised
+// as the manifest of the tree says
+func OpenURLIndex(dir string, key string) (idx *URLIndex, err error) {
+	m, err := ReadManifest(filepath.Dir(dir))
+	if errors.Is(err, os.ErrNotExist) {
+		m, err = &Manifest{}, nil
+	} else if err != nil {
+		return
+	}
+	return openURLIndex(dir, key, m)
+}
+
+// as OpenURLIndex, with keys canonicalised as m says
+func openURLIndex(dir string, key string, m *Manifest) (idx *URLIndex, err error) {
+	idx = &URLIndex{dir: dir, added: make(map[uint64]urlLoc), removed: make(map[uint32][]uint32)}
+
+	f, err := os.Open(filepath.Join(dir, URLIndexName))
+	if os.IsNotExist(err) {
+		err = idx.build(key, m)
+		return
+	} else if err != nil {
+		return
+	}
+	defer f.Close()
+
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		return
+	}
+	defer z.Close()
+	r := bufio.NewReader(z)
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading url index of %v: %w", dir, err)
+	}
+	idx.entries = make([]urlEntry, n)
+	hash := uint64(0)
+	for i := range idx.entries {
+		var delta, batch, row uint64
+		if delta, err = binary.ReadUvarint(r); err == nil {
+			if batch, err = binary.ReadUvarint(r); err == nil {
+				row, err = binary.ReadUvarint(r)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading url index of %v: %w", dir, err)
+		}
+		hash += delta
+		idx.entries[i] = urlEntry{hash, urlLoc{uint32(batch), uint32(row)}}
+	}
+	return
+}
+
+// index the rows of the batches by their key, as the shard looks them up
+func (idx *URLIndex) build(key string, m *Manifest) (err error) {
+	batches, err := Batches(idx.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil // a new shard
+		}
+		return
+	}
+	if len(batches) > 0 {
+		log.Printf("Building url index for %v", idx.dir)
+	}
+
+	for _, batch := range batches {
+		number, _ := strconv.Atoi(filepath.Base(batch))
+		r, err := NewColumnReader(batch, key)
+		if err != nil {
+			return err
+		}
+		row := uint32(0)
+		for r.Next() {
+			idx.added[URLHash([]byte(m.canonicalKey(string(r.Row()[key]))))] = urlLoc{uint32(number), row}
+			row++
+		}
+		err = r.Err()
+		if e := r.Close(); e != nil && err == nil {
+			err = e
+		}
+		if err != nil {
+			return fmt.Errorf("reading %v: %w", batch, err)
+		}
+	}
+	return
+}
+
+func (idx *URLIndex) Lookup(hash uint64) (batch int, row int64, ok bool) {
+	loc, ok := idx.added[hash]
+	if !ok {
+		i := sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].hash >= hash })
+		if i < len(idx.entries) && idx.entries[i].hash == hash {
+			loc, ok = idx.entries[i].urlLoc, true
+		}
+	}
+	return int(loc.batch), int64(loc.row), ok
+}
+
+func (idx *URLIndex) Put(hash uint64, batch int, row int64) {
+	idx.added[hash] = urlLoc{uint32(batch), uint32(row)}
+}
+
+// mark the row for removal when the index is closed
+func (idx *URLIndex) Remove(batch int, row int64) {
+	idx.removed[uint32(batch)] = append(idx.removed[uint32(batch)], uint32(row))
+}
+
+// merge the new entries into the sorted ones
+func (idx *URLIndex) merge() {
+	if len(idx.added) == 0 {
+		return
+	}
+	kept := idx.entries[:0]
+	for _, e := range idx.entries {
+		if _, ok := idx.added[e.hash]; !ok {
+			kept = append(kept, e)
+		}
+	}
+	for hash, loc := range idx.added {
+		kept = append(kept, urlEntry{hash, loc})
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].hash < kept[j].hash })
+	idx.entries = kept
+	idx.added = make(map[uint64]urlLoc)
+}
+
+// remove the rows marked for removal from their batches, and renumber
+// the remaining rows in the index to match. each batch rewritten is
+// given to hook, if there is one
+func (idx *URLIndex) applyRemovals(cols []string, hook SealHook) (err error) {
+	idx.merge()
+	for batch, rows := range idx.removed {
+		sort.Slice(rows, func(i, j int) bool { return rows[i] < rows[j] })
+		drop := make(map[int64]bool, len(rows))
+		for _, r := range rows {
+			drop[int64(r)] = true
+		}
+
+		bdir := filepath.Join(idx.dir, strconv.Itoa(int(batch)))
+		_, dropped, err := RewriteBatch(bdir, cols, func(i int64, row map[string][]byte) (bool, error) {
+			return !drop[i], nil
+		})
+		if err != nil {
+			return fmt.Errorf("removing replaced rows from %v: %w", bdir, err)
+		}
+		log.Printf("Removed %d replaced rows from %v", dropped, bdir)
+		if hook != nil {
+			sb, err := resealedBatch(bdir, int(batch), cols)
+			if err != nil {
+				return err
+			}
+			if err = hook(sb); err != nil {
+				return err
+			}
+		}
+
+		for i := range idx.entries {
+			e := &idx.entries[i]
+			if e.batch == batch {
+				// rows before it that were removed
+				e.row -= uint32(sort.Search(len(rows), func(j int) bool { return rows[j] >= e.row }))
+			}
+		}
+	}
+	idx.removed = make(map[uint32][]uint32)
+	return
+}
+
+// write the index back, first removing any replaced rows from the
+// batches, which are given to hook again if it is not nil
+func (idx *URLIndex) Close(cols []string, hook SealHook) (err error) {
+	if err = idx.applyRemovals(cols, hook); err != nil {
+		return
+	}
+	if len(idx.entries) == 0 {
+		return
+	}
+
+	tmp := filepath.Join(idx.dir, URLIndexName+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+	z, err := gzip.NewWriterLevel(f, gzip.BestCompression)
+	if err != nil {
+		f.Close()
+		return
+	}
+	w := bufio.NewWriter(z)
+
+	buf := make([]byte, 3*binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(len(idx.entries)))
+	_, err = w.Write(buf[:n])
+	prev := uint64(0)
+	for _, e := range idx.entries {
+		if err != nil {
+			break
+		}
+		n = binary.PutUvarint(buf, e.hash-prev)
+		n += binary.PutUvarint(buf[n:], uint64(e.batch))
+		n += binary.PutUvarint(buf[n:], uint64(e.row))
+		_, err = w.Write(buf[:n])
+		prev = e.hash
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if e := z.Close(); e != nil && err == nil {
+		err = e
+	}
+	if e := f.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+	return os.Rename(tmp, filepath.Join(idx.dir, URLIndexName))
+}
+
+// keep a url index for each shard, and use it to decide what to do with
+// rows whose url is already in the shard. once a tree has indexes, later
+// runs keep them up to date
+func (s *Shard) Index(mode IndexMode) {
+	s.indexmode = mode
+	if s.indexes == nil {
+		s.indexes = make([]*URLIndex, 1<<s.n)
+	}
+	s.manifest.Indexed = true
+	s.summary.Index = &IndexSummary{Mode: mode.String()}
+}
+
+func (s *Shard) urlIndex(shard uint64) (idx *URLIndex, err error) {
+	if idx = s.indexes[shard]; idx == nil {
+		if idx, err = openURLIndex(s.shardDir(shard), s.key, s.manifest); err != nil {
+			return
+		}
+		s.indexes[shard] = idx
+	}
+	return
+}
+
+// count the row against the index, returning whether to leave it out
+func (s *Shard) checkIndex(idx *URLIndex, hash uint64) (skip bool) {
+	batch, row, ok := idx.Lookup(hash)
+	if !ok {
+		s.summary.Index.New++
+		return
+	}
+	s.summary.Index.Existing++
+	switch s.indexmode {
+	case IndexSkip:
+		s.summary.Index.Skipped++
+		return true
+	case IndexReplace:
+		idx.Remove(batch, row)
+		s.summary.Index.Replaced++
+	}
+	return
+}
@@ -0,0 +1,147 @@
+package giashard
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeRows(t *testing.T, dir string, mode IndexMode, urls ...string) *Summary {
+	s, err := NewShard(dir, 0, 1<<20, "url", "url", "text")
+	if err != nil {
+		t.Fatalf("NewShard: error: %v", err)
+	}
+	s.Index(mode)
+	for _, u := range urls {
+		if err := s.WriteRow(map[string][]byte{"url": []byte(u), "text": []byte("t " + u)}); err != nil {
+			t.Fatalf("WriteRow(%v): error: %v", u, err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: error: %v", err)
+	}
+	return s.Summary()
+}
+
+func TestURLIndex(t *testing.T) {
+	dir := t.TempDir()
+	urls := make([]string, 10)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://example.com/%d", i)
+	}
+
+	writeRows(t, dir, IndexAppend, urls...)
+	sum := writeRows(t, dir, IndexSkip, urls[5:]...)
+	if sum.Index.Skipped != 5 || sum.Written != 0 {
+		t.Errorf("skip: %v", sum)
+	}
+	sum = writeRows(t, dir, IndexReplace, urls[2], urls[7], "http://example.com/new")
+	if sum.Index.Replaced != 2 || sum.Index.New != 1 || sum.Written != 3 {
+		t.Errorf("replace: %v", sum)
+	}
+
+	// every url is there once, and the index points at it
+	idx, err := OpenURLIndex(filepath.Join(dir, "0"), "url")
+	if err != nil {
+		t.Fatalf("OpenURLIndex: error: %v", err)
+	}
+	r, err := NewColumnReader(filepath.Join(dir, "0", "1"), "url")
+	if err != nil {
+		t.Fatalf("NewColumnReader: error: %v", err)
+	}
+	defer r.Close()
+	row := int64(0)
+	seen := make(map[string]bool)
+	for cols := range r.Rows() {
+		u := string(cols["url"])
+		if seen[u] {
+			t.Errorf("%v written twice", u)
+		}
+		seen[u] = true
+		batch, irow, ok := idx.Lookup(URLHash(cols["url"]))
+		if !ok || batch != 1 || irow != row {
+			t.Errorf("index for %v: got %d/%d (%v) expected 1/%d", u, batch, irow, ok, row)
+		}
+		row++
+	}
+	if row != 11 {
+		t.Errorf("expected 11 rows, got %d", row)
+	}
+}
+
+func TestURLIndexRebuildCanonical(t *testing.T) {
+	dir := t.TempDir()
+	urls := []string{"http://Example.com/a?utm_source=x", "http://example.com/b#top"}
+	write := func(mode IndexMode, urls ...string) *Summary {
+		s, err := NewShard(dir, 0, 1<<20, "url", "url", "text")
+		if err != nil {
+			t.Fatalf("NewShard: error: %v", err)
+		}
+		c, err := NewCanonicaliser()
+		if err != nil {
+			t.Fatalf("NewCanonicaliser: error: %v", err)
+		}
+		if err = s.CanonicaliseKey(c); err != nil {
+			t.Fatalf("CanonicaliseKey: error: %v", err)
+		}
+		s.Index(mode)
+		for _, u := range urls {
+			if err := s.WriteRow(map[string][]byte{"url": []byte(u), "text": []byte("t")}); err != nil {
+				t.Fatalf("WriteRow(%v): error: %v", u, err)
+			}
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("Close: error: %v", err)
+		}
+		return s.Summary()
+	}
+	write(IndexAppend, urls...)
+
+	// as giatakedown leaves it, the index is built again from the batches
+	if err := os.Remove(filepath.Join(dir, "0", URLIndexName)); err != nil {
+		t.Fatal(err)
+	}
+	sum := write(IndexSkip, "http://example.com/a", "http://example.com/b")
+	if sum.Index.Skipped != 2 || sum.Written != 0 {
+		t.Errorf("expected the rebuilt index to skip both urls: %v", sum)
+	}
+}
+
+func TestURLIndexReplaceSeal(t *testing.T) {
+	dir := t.TempDir()
+	writeRows(t, dir, IndexAppend, "http://example.com/a", "http://example.com/b", "http://example.com/c")
+
+	s, err := NewShard(dir, 0, 1<<20, "url", "url", "text")
+	if err != nil {
+		t.Fatalf("NewShard: error: %v", err)
+	}
+	s.Index(IndexReplace)
+	var sealed []*SealedBatch
+	s.OnSeal(func(sb *SealedBatch) error {
+		sealed = append(sealed, sb)
+		return nil
+	})
+	if err = s.WriteRow(map[string][]byte{"url": []byte("http://example.com/b"), "text": []byte("new b")}); err != nil {
+		t.Fatalf("WriteRow: error: %v", err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close: error: %v", err)
+	}
+
+	// sealed with the replaced row, then again once it is removed
+	if len(sealed) != 2 || sealed[0].Rows != 4 || sealed[0].Rewritten {
+		t.Fatalf("expected the batch sealed with 4 rows, then again, got %d seals", len(sealed))
+	}
+	sb := sealed[1]
+	if !sb.Rewritten || sb.Rows != 3 || sb.Batch != 1 || sb.Bytes["text"] == 0 {
+		t.Errorf("expected the batch sealed again with 3 rows, got %+v", sb)
+	}
+	m, err := ReadBatchMeta(sb.Path)
+	if err != nil || m.Rows != 3 || m.Columns["text"].Compressed != sb.Compressed["text"] {
+		t.Errorf("expected metadata to match the second seal, got %+v, %v", m, err)
+	}
+	if err = VerifyBatch(sb.Path); err != nil {
+		t.Errorf("VerifyBatch: error: %v", err)
+	}
+}